@@ -1,3 +1,14 @@
 module github.com/emersion/go-maildir
 
-go 1.23
+go 1.23.0
+
+require (
+	github.com/emersion/go-message v0.18.2
+	golang.org/x/sys v0.35.0
+)
+
+require (
+	github.com/emersion/go-imap/v2 v2.0.0-beta.8
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
+	github.com/emersion/go-smtp v0.24.0
+)
@@ -0,0 +1,798 @@
+package imapmaildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// uidlistFilename is the name of the file storing the UIDs of the messages
+// of a Maildir.
+const uidlistFilename = "maildir.uidlist"
+
+// uidlistHeader is the first line of a UID list file. The second line
+// contains the UIDVALIDITY and the next UID, and the following ones the UID
+// and the key of each message.
+const uidlistHeader = "maildir-uidlist 1"
+
+// errInvalidUIDList is returned when a UID list file cannot be parsed.
+var errInvalidUIDList = errors.New("imapmaildir: invalid UID list")
+
+// mtimeGranularity is the time after which the modification time of a
+// directory is trusted to reflect all the changes made to it. Some
+// filesystems only store it with a one second precision.
+const mtimeGranularity = 2 * time.Second
+
+// mailboxFlags are the IMAP flags which can be stored in a Maildir.
+var mailboxFlags = []imap.Flag{
+	imap.FlagAnswered,
+	imap.FlagDeleted,
+	imap.FlagDraft,
+	imap.FlagFlagged,
+	imap.FlagSeen,
+}
+
+var errReadOnly = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeCannot,
+	Text: "Mailbox is read-only",
+}
+
+// mailbox is the state of a Maildir, shared by all the sessions.
+type mailbox struct {
+	tracker *imapserver.MailboxTracker
+	dir     *maildirpp.Dir
+
+	mutex       sync.Mutex
+	uidValidity uint32 // immutable once loaded
+	uidNext     imap.UID
+	l           []*message // sorted by UID
+
+	// modification times of new and cur at the last refresh
+	newMtime, curMtime time.Time
+}
+
+type message struct {
+	uid   imap.UID
+	key   string
+	flags maildirpp.Flags
+	msg   *maildirpp.Message // resolved on demand
+}
+
+// openMailbox loads the state of a Maildir. uidValidity is used if the
+// Maildir has no UIDs yet.
+func openMailbox(path string, uidValidity uint32) (*mailbox, error) {
+	mbox := &mailbox{
+		dir:         maildirpp.NewDir(path),
+		uidValidity: uidValidity,
+		uidNext:     1,
+	}
+	rebuild := false
+	if err := mbox.load(); errors.Is(err, errInvalidUIDList) {
+		// The UID list is unreadable, e.g. truncated by a crash: start over
+		// with a new UIDVALIDITY, so that clients discard the UIDs they know
+		if uidValidity <= mbox.uidValidity {
+			uidValidity = mbox.uidValidity + 1
+		}
+		mbox.uidValidity = uidValidity
+		mbox.uidNext = 1
+		mbox.l = nil
+		rebuild = true
+	} else if err != nil {
+		return nil, err
+	}
+	mbox.tracker = imapserver.NewMailboxTracker(uint32(len(mbox.l)))
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+	if err := mbox.refreshLocked(); err != nil {
+		return nil, err
+	}
+	if rebuild {
+		if err := mbox.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return mbox, nil
+}
+
+func (mbox *mailbox) uidlistPath() string {
+	return filepath.Join(string(mbox.dir.Dir), uidlistFilename)
+}
+
+// load reads the UID list. The flags of the messages are set by the first
+// refresh.
+func (mbox *mailbox) load() error {
+	f, err := os.Open(mbox.uidlistPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	invalid := fmt.Errorf("%w %q", errInvalidUIDList, f.Name())
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != uidlistHeader || !scanner.Scan() {
+		return invalid
+	}
+	if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &mbox.uidValidity, &mbox.uidNext); err != nil {
+		return invalid
+	}
+	var prevUID imap.UID
+	for scanner.Scan() {
+		s, key, _ := strings.Cut(scanner.Text(), " ")
+		n, err := strconv.ParseUint(s, 10, 32)
+		uid := imap.UID(n)
+		if err != nil || key == "" || uid <= prevUID || uid >= mbox.uidNext {
+			return invalid
+		}
+		mbox.l = append(mbox.l, &message{uid: uid, key: key})
+		prevUID = uid
+	}
+	return scanner.Err()
+}
+
+func (mbox *mailbox) saveLocked() error {
+	var buf bytes.Buffer
+	fmt.Fprintln(&buf, uidlistHeader)
+	fmt.Fprintf(&buf, "%d %d\n", mbox.uidValidity, mbox.uidNext)
+	for _, msg := range mbox.l {
+		fmt.Fprintf(&buf, "%d %s\n", msg.uid, msg.key)
+	}
+	return writeFile(string(mbox.dir.Dir), uidlistFilename, buf.Bytes())
+}
+
+// refreshLocked picks up the changes made to the Maildir by other programs:
+// the messages in new are moved to cur and get a UID, the messages which
+// disappeared are expunged, and flag changes are queued.
+//
+// The directories are only scanned if their modification time changed since
+// the last refresh, or is too recent to be trusted.
+func (mbox *mailbox) refreshLocked() error {
+	newMtime, curMtime, err := mbox.mtimes()
+	if err != nil {
+		return err
+	}
+	if newMtime.Equal(mbox.newMtime) && curMtime.Equal(mbox.curMtime) &&
+		time.Since(newMtime) > mtimeGranularity && time.Since(curMtime) > mtimeGranularity {
+		return nil
+	}
+	if err := mbox.scanLocked(); err != nil {
+		return err
+	}
+	// taken before the scan, so that concurrent changes are picked up by the
+	// next refresh
+	mbox.newMtime, mbox.curMtime = newMtime, curMtime
+	return nil
+}
+
+// mtimes returns the modification times of new and cur.
+func (mbox *mailbox) mtimes() (newMtime, curMtime time.Time, err error) {
+	fi, err := os.Stat(filepath.Join(string(mbox.dir.Dir), "new"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	newMtime = fi.ModTime()
+	fi, err = os.Stat(filepath.Join(string(mbox.dir.Dir), "cur"))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return newMtime, fi.ModTime(), nil
+}
+
+// scanLocked scans the Maildir for the changes picked up by refreshLocked.
+func (mbox *mailbox) scanLocked() error {
+	if _, err := mbox.dir.Unseen(); err != nil {
+		return err
+	}
+	cur, err := mbox.dir.Snapshot()
+	if cur == nil {
+		return err
+	}
+	// delivered since Unseen, picked up next time
+	maps.DeleteFunc(cur, func(key string, entry maildirpp.SnapshotEntry) bool {
+		return entry.New
+	})
+
+	prev := make(maildirpp.Snapshot, len(mbox.l))
+	for _, msg := range mbox.l {
+		prev[msg.key] = maildirpp.SnapshotEntry{Flags: msg.flags}
+	}
+	diff := maildirpp.Diff(prev, cur)
+
+	if len(diff.Removed) > 0 {
+		mbox.expungeLocked(keySet(diff.Removed))
+	}
+	if len(diff.FlagsChanged) > 0 {
+		changed := keySet(diff.FlagsChanged)
+		for i, msg := range mbox.l {
+			if _, ok := changed[msg.key]; !ok {
+				continue
+			}
+			msg.flags = cur[msg.key].Flags
+			msg.msg = nil
+			mbox.tracker.QueueMessageFlags(uint32(i)+1, msg.uid, flagList(msg.flags), nil)
+		}
+	}
+	for _, key := range diff.Added {
+		mbox.l = append(mbox.l, &message{
+			uid:   mbox.uidNext,
+			key:   key,
+			flags: cur[key].Flags,
+		})
+		mbox.uidNext++
+	}
+	if len(diff.Added) > 0 {
+		mbox.tracker.QueueNumMessages(uint32(len(mbox.l)))
+	}
+
+	if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+		return mbox.saveLocked()
+	}
+	return nil
+}
+
+func keySet(keys []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		m[key] = struct{}{}
+	}
+	return m
+}
+
+// addLocked assigns UIDs to messages added by a session, and saves them. A
+// message might already have been found by a refresh.
+func (mbox *mailbox) addLocked(msgs ...*maildirpp.Message) (imap.UIDSet, error) {
+	var uids imap.UIDSet
+	added := false
+	for _, m := range msgs {
+		key := m.Key()
+		var msg *message
+		for i := len(mbox.l) - 1; i >= 0; i-- {
+			if mbox.l[i].key == key {
+				msg = mbox.l[i]
+				break
+			}
+		}
+		if msg == nil {
+			msg = &message{uid: mbox.uidNext, key: key, flags: m.Flags(), msg: m}
+			mbox.l = append(mbox.l, msg)
+			mbox.uidNext++
+			added = true
+		}
+		uids.AddNum(msg.uid)
+	}
+	if !added {
+		return uids, nil
+	}
+	mbox.tracker.QueueNumMessages(uint32(len(mbox.l)))
+	return uids, mbox.saveLocked()
+}
+
+// expungeLocked removes messages by key, and queues EXPUNGE updates.
+func (mbox *mailbox) expungeLocked(keys map[string]struct{}) {
+	// Iterate in reverse order, to keep sequence numbers consistent
+	var kept []*message
+	for i := len(mbox.l) - 1; i >= 0; i-- {
+		msg := mbox.l[i]
+		if _, ok := keys[msg.key]; ok {
+			mbox.tracker.QueueExpunge(uint32(i) + 1)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	mbox.l = kept
+}
+
+// messageLocked resolves the file of a message.
+func (mbox *mailbox) messageLocked(msg *message) (*maildirpp.Message, error) {
+	if msg.msg == nil {
+		m, err := mbox.dir.MessageByKey(msg.key)
+		if err != nil {
+			return nil, err
+		}
+		msg.msg = m
+	}
+	return msg.msg, nil
+}
+
+// isGone reports whether an error occurred because a message was removed by
+// another program. The message is expunged by the next refresh.
+func isGone(err error) bool {
+	var keyErr *maildirpp.KeyError
+	return errors.As(err, &keyErr) || errors.Is(err, fs.ErrNotExist)
+}
+
+func (mbox *mailbox) status(name string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+
+	if err := mbox.refreshLocked(); err != nil {
+		return nil, err
+	}
+
+	data := imap.StatusData{Mailbox: name}
+	if options.NumMessages {
+		num := uint32(len(mbox.l))
+		data.NumMessages = &num
+	}
+	if options.UIDNext {
+		data.UIDNext = mbox.uidNext
+	}
+	if options.UIDValidity {
+		data.UIDValidity = mbox.uidValidity
+	}
+	if options.NumUnseen {
+		num := uint32(len(mbox.l)) - mbox.countLocked(maildirpp.FlagSeen)
+		data.NumUnseen = &num
+	}
+	if options.NumDeleted {
+		num := mbox.countLocked(maildirpp.FlagTrashed)
+		data.NumDeleted = &num
+	}
+	if options.Size {
+		size, err := mbox.sizeLocked()
+		if err != nil {
+			return nil, err
+		}
+		data.Size = &size
+	}
+	if options.NumRecent {
+		num := uint32(0)
+		data.NumRecent = &num
+	}
+	return &data, nil
+}
+
+func (mbox *mailbox) countLocked(flag maildirpp.Flag) uint32 {
+	var n uint32
+	for _, msg := range mbox.l {
+		if msg.flags.Has(flag) {
+			n++
+		}
+	}
+	return n
+}
+
+func (mbox *mailbox) sizeLocked() (int64, error) {
+	var total int64
+	for _, msg := range mbox.l {
+		m, err := mbox.messageLocked(msg)
+		if isGone(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		size, err := m.Size()
+		if isGone(err) {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+func (mbox *mailbox) selectDataLocked(readOnly bool) *imap.SelectData {
+	var permanentFlags []imap.Flag
+	if !readOnly {
+		permanentFlags = mailboxFlags
+	}
+
+	var firstUnseenSeqNum uint32
+	for i, msg := range mbox.l {
+		if !msg.flags.Has(maildirpp.FlagSeen) {
+			firstUnseenSeqNum = uint32(i) + 1
+			break
+		}
+	}
+
+	return &imap.SelectData{
+		Flags:             mailboxFlags,
+		PermanentFlags:    permanentFlags,
+		NumMessages:       uint32(len(mbox.l)),
+		FirstUnseenSeqNum: firstUnseenSeqNum,
+		UIDNext:           mbox.uidNext,
+		UIDValidity:       mbox.uidValidity,
+	}
+}
+
+func (mbox *mailbox) appendLiteral(r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	opts := &maildirpp.CreateOptions{InternalDate: options.Time}
+	m, err := mbox.dir.Append(r, parseFlags(options.Flags), nil, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+	uids, err := mbox.addLocked(m)
+	if err != nil {
+		return nil, err
+	}
+	return &imap.AppendData{
+		UIDValidity: mbox.uidValidity,
+		UID:         uids[0].Start,
+	}, nil
+}
+
+// newViewLocked creates a view of the mailbox for a session. The caller must hold
+// the mailbox lock, so that no update is missed between the SELECT response
+// and the creation of the view.
+func (mbox *mailbox) newViewLocked(readOnly bool) *mailboxView {
+	return &mailboxView{
+		mailbox:  mbox,
+		tracker:  mbox.tracker.NewSession(),
+		readOnly: readOnly,
+	}
+}
+
+// mailboxView is the view of a mailbox selected by a session, with its own
+// queue of pending updates.
+type mailboxView struct {
+	*mailbox
+	tracker   *imapserver.SessionTracker
+	readOnly  bool
+	searchRes imap.UIDSet
+}
+
+func (view *mailboxView) close() {
+	view.tracker.Close()
+}
+
+func (view *mailboxView) Fetch(w *imapserver.FetchWriter, numSet imap.NumSet, options *imap.FetchOptions) error {
+	markSeen := false
+	for _, bs := range options.BodySection {
+		if !bs.Peek {
+			markSeen = !view.readOnly
+			break
+		}
+	}
+
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+
+	return view.forEachLocked(numSet, func(seqNum uint32, msg *message) error {
+		m, err := view.messageLocked(msg)
+		if isGone(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if markSeen && !msg.flags.Has(maildirpp.FlagSeen) {
+			if err := m.AddFlags(maildirpp.FlagSeen); err != nil {
+				return err
+			}
+			msg.flags = m.Flags()
+			view.mailbox.tracker.QueueMessageFlags(seqNum, msg.uid, flagList(msg.flags), nil)
+		}
+
+		return fetchMessage(w.CreateMessage(view.tracker.EncodeSeqNum(seqNum)), msg, m, options)
+	})
+}
+
+func (view *mailboxView) Search(numKind imapserver.NumKind, criteria *imap.SearchCriteria, options *imap.SearchOptions) (*imap.SearchData, error) {
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+
+	view.staticSearchCriteria(criteria)
+	msgs, err := view.dir.Search(view.searchCriteria(criteria))
+	if err := searchError(err); err != nil {
+		return nil, err
+	}
+	matched := make(map[string]struct{}, len(msgs))
+	for _, m := range msgs {
+		matched[m.Key()] = struct{}{}
+	}
+
+	var (
+		data   imap.SearchData
+		seqSet imap.SeqSet
+		uidSet imap.UIDSet
+	)
+	for i, msg := range view.l {
+		if _, ok := matched[msg.key]; !ok {
+			continue
+		}
+		seqNum := view.tracker.EncodeSeqNum(uint32(i) + 1)
+
+		// Always populate the UID set, since it may be saved later for SEARCHRES
+		uidSet.AddNum(msg.uid)
+
+		var num uint32
+		switch numKind {
+		case imapserver.NumKindSeq:
+			if seqNum == 0 {
+				continue
+			}
+			seqSet.AddNum(seqNum)
+			num = seqNum
+		case imapserver.NumKindUID:
+			num = uint32(msg.uid)
+		}
+		if data.Min == 0 || num < data.Min {
+			data.Min = num
+		}
+		if data.Max == 0 || num > data.Max {
+			data.Max = num
+		}
+		data.Count++
+	}
+
+	switch numKind {
+	case imapserver.NumKindSeq:
+		data.All = seqSet
+	case imapserver.NumKindUID:
+		data.All = uidSet
+	}
+
+	if options.ReturnSave {
+		view.searchRes = uidSet
+	}
+
+	return &data, nil
+}
+
+func (view *mailboxView) staticSearchCriteria(criteria *imap.SearchCriteria) {
+	seqNums := make([]imap.SeqSet, 0, len(criteria.SeqNum))
+	for _, seqSet := range criteria.SeqNum {
+		switch numSet := view.staticNumSet(seqSet).(type) {
+		case imap.SeqSet:
+			seqNums = append(seqNums, numSet)
+		case imap.UIDSet: // can happen with SEARCHRES
+			criteria.UID = append(criteria.UID, numSet)
+		}
+	}
+	criteria.SeqNum = seqNums
+
+	for i, uidSet := range criteria.UID {
+		criteria.UID[i] = view.staticNumSet(uidSet).(imap.UIDSet)
+	}
+
+	for i := range criteria.Not {
+		view.staticSearchCriteria(&criteria.Not[i])
+	}
+	for i := range criteria.Or {
+		for j := range criteria.Or[i] {
+			view.staticSearchCriteria(&criteria.Or[i][j])
+		}
+	}
+}
+
+// Store changes the flags of messages. Keywords are ignored, since they
+// cannot be stored in a Maildir.
+func (view *mailboxView) Store(w *imapserver.FetchWriter, numSet imap.NumSet, flags *imap.StoreFlags, options *imap.StoreOptions) error {
+	if view.readOnly {
+		return errReadOnly
+	}
+
+	storeFlags := parseFlags(flags.Flags)
+
+	view.mutex.Lock()
+	err := view.forEachLocked(numSet, func(seqNum uint32, msg *message) error {
+		var newFlags maildirpp.Flags
+		switch flags.Op {
+		case imap.StoreFlagsSet:
+			// keep the flags without IMAP equivalent
+			newFlags = storeFlags
+			for _, f := range msg.flags {
+				if f.IMAP() == "" {
+					newFlags = newFlags.Add(f)
+				}
+			}
+		case imap.StoreFlagsAdd:
+			newFlags = msg.flags.Add(storeFlags...)
+		case imap.StoreFlagsDel:
+			newFlags = msg.flags.Remove(storeFlags...)
+		default:
+			return fmt.Errorf("imapmaildir: unknown STORE flag operation: %v", flags.Op)
+		}
+		if newFlags.Equal(msg.flags) {
+			return nil
+		}
+
+		m, err := view.messageLocked(msg)
+		if isGone(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := m.SetFlags(newFlags); isGone(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		msg.flags = m.Flags()
+		view.mailbox.tracker.QueueMessageFlags(seqNum, msg.uid, flagList(msg.flags), view.tracker)
+		return nil
+	})
+	view.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if !flags.Silent {
+		return view.Fetch(w, numSet, &imap.FetchOptions{Flags: true})
+	}
+	return nil
+}
+
+// Expunge permanently removes the messages flagged as deleted, with
+// Dir.Expunge.
+func (view *mailboxView) Expunge(w *imapserver.ExpungeWriter, uids *imap.UIDSet) error {
+	if view.readOnly {
+		return errReadOnly
+	}
+
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+
+	keys := make(map[string]struct{})
+	for _, msg := range view.l {
+		if uids == nil || uids.Contains(msg.uid) {
+			keys[msg.key] = struct{}{}
+		}
+	}
+	removed, err := view.dir.Expunge(&maildirpp.ExpungeOptions{
+		Filter: func(m *maildirpp.Message) bool {
+			_, ok := keys[m.Key()]
+			return ok
+		},
+	})
+	if len(removed) == 0 {
+		return err
+	}
+	view.expungeLocked(keySet(removed))
+	return errors.Join(err, view.saveLocked())
+}
+
+// Poll refreshes the mailbox and dequeues the pending updates.
+func (view *mailboxView) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	if err := view.refresh(); err != nil {
+		return err
+	}
+	return view.tracker.Poll(w, allowExpunge)
+}
+
+// Idle writes the pending updates until stop is closed. The mailbox is
+// refreshed every interval. Refresh errors are reported by the next poll.
+func (view *mailboxView) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}, interval time.Duration) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				view.refresh()
+			case <-stop:
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return view.tracker.Idle(w, stop)
+}
+
+func (view *mailboxView) refresh() error {
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+	return view.refreshLocked()
+}
+
+// messages returns copies of the resolved messages in numSet, and their UIDs.
+// Messages removed by another program are skipped.
+func (view *mailboxView) messages(numSet imap.NumSet) ([]*maildirpp.Message, []imap.UID, error) {
+	view.mutex.Lock()
+	defer view.mutex.Unlock()
+
+	var (
+		msgs []*maildirpp.Message
+		uids []imap.UID
+	)
+	err := view.forEachLocked(numSet, func(seqNum uint32, msg *message) error {
+		m, err := view.messageLocked(msg)
+		if isGone(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c := *m
+		msgs = append(msgs, &c)
+		uids = append(uids, msg.uid)
+		return nil
+	})
+	return msgs, uids, err
+}
+
+// forEachLocked calls fn for each message in numSet, with its sequence
+// number in the mailbox, until fn returns an error.
+func (view *mailboxView) forEachLocked(numSet imap.NumSet, fn func(seqNum uint32, msg *message) error) error {
+	numSet = view.staticNumSet(numSet)
+
+	for i, msg := range view.l {
+		seqNum := uint32(i) + 1
+
+		var contains bool
+		switch numSet := numSet.(type) {
+		case imap.SeqSet:
+			seqNum := view.tracker.EncodeSeqNum(seqNum)
+			contains = seqNum != 0 && numSet.Contains(seqNum)
+		case imap.UIDSet:
+			contains = numSet.Contains(msg.uid)
+		}
+		if !contains {
+			continue
+		}
+
+		if err := fn(seqNum, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// staticNumSet converts a dynamic sequence set into a static one.
+//
+// This is necessary to properly handle the special symbol "*", which
+// represents the maximum sequence number or UID in the mailbox.
+//
+// This function also handles the special SEARCHRES marker "$".
+func (view *mailboxView) staticNumSet(numSet imap.NumSet) imap.NumSet {
+	if imap.IsSearchRes(numSet) {
+		return view.searchRes
+	}
+
+	switch numSet := numSet.(type) {
+	case imap.SeqSet:
+		max := uint32(len(view.l))
+		for i := range numSet {
+			r := &numSet[i]
+			staticNumRange(&r.Start, &r.Stop, max)
+		}
+	case imap.UIDSet:
+		max := uint32(view.uidNext) - 1
+		for i := range numSet {
+			r := &numSet[i]
+			staticNumRange((*uint32)(&r.Start), (*uint32)(&r.Stop), max)
+		}
+	}
+
+	return numSet
+}
+
+func staticNumRange(start, stop *uint32, max uint32) {
+	dyn := false
+	if *start == 0 {
+		*start = max
+		dyn = true
+	}
+	if *stop == 0 {
+		*stop = max
+		dyn = true
+	}
+	if dyn && *start > *stop {
+		*start, *stop = *stop, *start
+	}
+}
@@ -0,0 +1,225 @@
+package imapmaildir
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-maildir/maildirpp"
+	"github.com/emersion/go-message/textproto"
+)
+
+// flagList returns the IMAP flags of a message. Flags without IMAP
+// equivalent, like FlagPassed, are omitted.
+func flagList(flags maildirpp.Flags) []imap.Flag {
+	l := make([]imap.Flag, 0, len(flags))
+	for _, name := range flags.IMAP() {
+		l = append(l, imap.Flag(name))
+	}
+	return l
+}
+
+// parseFlags returns the Maildir flags corresponding to IMAP flags. Keywords
+// are dropped.
+func parseFlags(l []imap.Flag) maildirpp.Flags {
+	names := make([]string, len(l))
+	for i, flag := range l {
+		names[i] = string(flag)
+	}
+	flags, _ := maildirpp.ParseIMAPFlags(names)
+	return flags
+}
+
+func fetchMessage(w *imapserver.FetchResponseWriter, msg *message, m *maildirpp.Message, options *imap.FetchOptions) error {
+	w.WriteUID(msg.uid)
+
+	if options.Flags {
+		w.WriteFlags(flagList(msg.flags))
+	}
+	if options.InternalDate {
+		t, err := m.InternalDate()
+		if err != nil {
+			return err
+		}
+		w.WriteInternalDate(t)
+	}
+	if options.RFC822Size {
+		size, err := m.Size()
+		if err != nil {
+			return err
+		}
+		w.WriteRFC822Size(size)
+	}
+
+	needsContent := options.Envelope || options.BodyStructure != nil ||
+		len(options.BodySection) > 0 || len(options.BinarySection) > 0 ||
+		len(options.BinarySectionSize) > 0
+	if !needsContent {
+		return w.Close()
+	}
+
+	r, err := m.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	content := func() io.Reader {
+		return io.NewSectionReader(r, 0, math.MaxInt64)
+	}
+
+	if options.Envelope {
+		h, err := textproto.ReadHeader(bufio.NewReader(content()))
+		if err != nil {
+			return err
+		}
+		w.WriteEnvelope(imapserver.ExtractEnvelope(h))
+	}
+	if options.BodyStructure != nil {
+		w.WriteBodyStructure(imapserver.ExtractBodyStructure(content()))
+	}
+
+	for _, bs := range options.BodySection {
+		buf := imapserver.ExtractBodySection(content(), bs)
+		if err := writeSection(w.WriteBodySection(bs, int64(len(buf))), buf); err != nil {
+			return err
+		}
+	}
+	for _, bs := range options.BinarySection {
+		buf := imapserver.ExtractBinarySection(content(), bs)
+		if err := writeSection(w.WriteBinarySection(bs, int64(len(buf))), buf); err != nil {
+			return err
+		}
+	}
+	for _, bss := range options.BinarySectionSize {
+		w.WriteBinarySectionSize(bss, imapserver.ExtractBinarySectionSize(content(), bss))
+	}
+
+	return w.Close()
+}
+
+func writeSection(wc io.WriteCloser, buf []byte) error {
+	_, writeErr := wc.Write(buf)
+	closeErr := wc.Close()
+	if writeErr != nil {
+		return writeErr
+	}
+	return closeErr
+}
+
+// searchCriteria translates IMAP search criteria into Maildir search
+// criteria. Sequence numbers and UIDs are resolved to keys with the messages
+// of the view, whose lock must be held.
+func (view *mailboxView) searchCriteria(criteria *imap.SearchCriteria) *maildirpp.SearchCriteria {
+	c := &maildirpp.SearchCriteria{
+		Since:      localDate(criteria.Since),
+		Before:     localDate(criteria.Before),
+		SentSince:  criteria.SentSince,
+		SentBefore: criteria.SentBefore,
+		Larger:     criteria.Larger,
+		Smaller:    criteria.Smaller,
+		Body:       criteria.Body,
+		Text:       criteria.Text,
+	}
+	matchNone := false
+
+	if len(criteria.SeqNum) > 0 || len(criteria.UID) > 0 {
+		for i, msg := range view.l {
+			if view.containsLocked(criteria, uint32(i)+1, msg) {
+				c.Keys = append(c.Keys, msg.key)
+			}
+		}
+		matchNone = len(c.Keys) == 0
+		if len(c.Keys) == len(view.l) {
+			// the sets cover the whole view, e.g. 1:*, and messages which
+			// are not in the view are ignored anyway
+			c.Keys = nil
+		}
+	}
+
+	for _, flag := range criteria.Flag {
+		if f, ok := maildirpp.ParseIMAPFlag(string(flag)); ok {
+			c.Flag = append(c.Flag, f)
+		} else {
+			// keywords cannot be stored
+			matchNone = true
+		}
+	}
+	for _, flag := range criteria.NotFlag {
+		if f, ok := maildirpp.ParseIMAPFlag(string(flag)); ok {
+			c.NotFlag = append(c.NotFlag, f)
+		}
+	}
+
+	for _, field := range criteria.Header {
+		c.Header = append(c.Header, maildirpp.SearchCriteriaHeaderField{Key: field.Key, Value: field.Value})
+	}
+
+	for _, not := range criteria.Not {
+		c.Not = append(c.Not, *view.searchCriteria(&not))
+	}
+	for _, or := range criteria.Or {
+		c.Or = append(c.Or, [2]maildirpp.SearchCriteria{
+			*view.searchCriteria(&or[0]),
+			*view.searchCriteria(&or[1]),
+		})
+	}
+
+	if matchNone {
+		// no message has an empty key
+		c.Keys = []string{""}
+	}
+	return c
+}
+
+// containsLocked reports whether the message with the sequence number seqNum
+// is in all the sequence sets and UID sets of the criteria.
+func (view *mailboxView) containsLocked(criteria *imap.SearchCriteria, seqNum uint32, msg *message) bool {
+	seqNum = view.tracker.EncodeSeqNum(seqNum)
+	for _, seqSet := range criteria.SeqNum {
+		if seqNum == 0 || !seqSet.Contains(seqNum) {
+			return false
+		}
+	}
+	for _, uidSet := range criteria.UID {
+		if !uidSet.Contains(msg.uid) {
+			return false
+		}
+	}
+	return true
+}
+
+// localDate returns the start of the day of t in the local time zone, which
+// is the one of internal dates. RFC 3501 requires dates to be compared
+// without their time.
+func localDate(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// searchError drops the errors of messages removed by another program or
+// malformed during a search.
+func searchError(err error) error {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else if err != nil {
+		errs = []error{err}
+	}
+	var kept []error
+	for _, err := range errs {
+		var (
+			mailfileErr *maildirpp.MailfileError
+			flagErr     *maildirpp.FlagError
+		)
+		if !isGone(err) && !errors.As(err, &mailfileErr) && !errors.As(err, &flagErr) {
+			kept = append(kept, err)
+		}
+	}
+	return errors.Join(kept...)
+}
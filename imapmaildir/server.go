@@ -0,0 +1,85 @@
+// Package imapmaildir implements the session interfaces of the go-imap v2
+// server on top of Maildir++ directories.
+//
+// The INBOX of a user is the root Maildir, and the other mailboxes are the
+// Maildir++ folders it contains: the mailbox "Lists/Go" is stored in the
+// folder ".Lists.Go". Mailbox names cannot contain dots.
+//
+// Only the flags which have a Maildir equivalent are permanent: keywords are
+// not stored. UIDs are stored in a file in each Maildir, next to the
+// messages.
+//
+// Changes made to the Maildirs by other programs, e.g. deliveries, are picked
+// up when the mailbox is polled, i.e. after each command, and periodically
+// while the client is idle. Messages are moved from new to cur when they are
+// found.
+package imapmaildir
+
+import (
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2/imapserver"
+)
+
+// defaultIdleInterval is the default value of Options.IdleInterval.
+const defaultIdleInterval = 30 * time.Second
+
+// AuthFunc checks the credentials of a user, and returns the path to the root
+// of their Maildir++ hierarchy. It returns an error if the credentials are
+// invalid.
+type AuthFunc func(username, password string) (root string, err error)
+
+// Options contains options for New.
+type Options struct {
+	// The interval at which the selected mailbox is scanned for changes made
+	// by other programs while the client is idle. If zero, 30 seconds is
+	// used.
+	IdleInterval time.Duration
+}
+
+// Server creates IMAP sessions on Maildir++ directories.
+//
+// The state of the mailboxes is shared between all the sessions of a server,
+// so that sessions are notified of the changes made by the others. A
+// Maildir++ hierarchy should only be served by a single server.
+type Server struct {
+	authenticate AuthFunc
+	idleInterval time.Duration
+
+	mutex sync.Mutex
+	users map[string]*user // by root
+}
+
+// New creates a new server, authenticating users with authenticate.
+func New(authenticate AuthFunc, opts *Options) *Server {
+	if opts == nil {
+		opts = new(Options)
+	}
+	idleInterval := opts.IdleInterval
+	if idleInterval <= 0 {
+		idleInterval = defaultIdleInterval
+	}
+	return &Server{
+		authenticate: authenticate,
+		idleInterval: idleInterval,
+		users:        make(map[string]*user),
+	}
+}
+
+// NewSession creates a new IMAP session. It is meant to be called from
+// imapserver.Options.NewSession.
+func (s *Server) NewSession() imapserver.Session {
+	return &session{server: s}
+}
+
+func (s *Server) user(root string) *user {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.users[root]
+	if u == nil {
+		u = newUser(root)
+		s.users[root] = u
+	}
+	return u
+}
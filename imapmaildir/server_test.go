@@ -0,0 +1,468 @@
+package imapmaildir
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+const testMessage = "From: alice@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi Bob!\r\n"
+
+// newTestServer serves the Maildir++ hierarchy root on a local listener, and
+// returns a function connecting logged in clients.
+func newTestServer(t *testing.T, root string, opts *Options) func(*imapclient.Options) *imapclient.Client {
+	srv := New(func(username, password string) (string, error) {
+		if username != "bob" || password != "secret" {
+			return "", errors.New("invalid credentials")
+		}
+		return root, nil
+	}, opts)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := imapserver.New(&imapserver.Options{
+		NewSession: func(*imapserver.Conn) (imapserver.Session, *imapserver.GreetingData, error) {
+			return srv.NewSession(), nil, nil
+		},
+		Caps: imap.CapSet{
+			imap.CapIMAP4rev1: {},
+			imap.CapIMAP4rev2: {},
+		},
+		InsecureAuth: true,
+	})
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	return func(options *imapclient.Options) *imapclient.Client {
+		t.Helper()
+		c, err := imapclient.DialInsecure(ln.Addr().String(), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if err := c.Login("bob", "secret").Wait(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+}
+
+func newTestRoot(t *testing.T) string {
+	root := t.TempDir()
+	if err := maildirpp.NewDir(root).Init(); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	root := newTestRoot(t)
+	if err := maildirpp.Deliver(root, strings.NewReader(testMessage), nil); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, root, nil)(nil)
+
+	if err := c.Create("Lists/Go", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".Lists.Go", "cur")); err != nil {
+		t.Errorf("Maildir++ folder not created: %v", err)
+	}
+	if err := c.Create("a.b", nil).Wait(); err == nil {
+		t.Error("created a mailbox with a dot in its name")
+	}
+	list, err := c.List("", "*", nil).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, data := range list {
+		names = append(names, data.Mailbox)
+	}
+	if want := []string{"INBOX", "Lists/Go"}; !slices.Equal(names, want) {
+		t.Errorf("LIST = %v, want %v", names, want)
+	}
+
+	selectData, err := c.Select("INBOX", nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selectData.NumMessages != 1 || selectData.UIDNext != 2 {
+		t.Errorf("SELECT = %+v, want 1 message and UIDNEXT 2", selectData)
+	}
+
+	appendCmd := c.Append("INBOX", int64(len(testMessage)), &imap.AppendOptions{
+		Flags: []imap.Flag{imap.FlagSeen},
+	})
+	if _, err := appendCmd.Write([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendCmd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	appendData, err := appendCmd.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appendData.UID != 2 || appendData.UIDValidity != selectData.UIDValidity {
+		t.Errorf("APPEND = %+v", appendData)
+	}
+
+	bodySection := &imap.FetchItemBodySection{Peek: true}
+	msgs, err := c.Fetch(imap.SeqSetNum(1, 2), &imap.FetchOptions{
+		UID:         true,
+		Flags:       true,
+		Envelope:    true,
+		RFC822Size:  true,
+		BodySection: []*imap.FetchItemBodySection{bodySection},
+	}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("FETCH returned %v messages, want 2", len(msgs))
+	}
+	if msgs[0].UID != 1 || len(msgs[0].Flags) != 0 {
+		t.Errorf("first message: UID = %v, flags = %v", msgs[0].UID, msgs[0].Flags)
+	}
+	if msgs[1].UID != 2 || !slices.Equal(msgs[1].Flags, []imap.Flag{imap.FlagSeen}) {
+		t.Errorf("second message: UID = %v, flags = %v", msgs[1].UID, msgs[1].Flags)
+	}
+	if msgs[0].Envelope.Subject != "Hello" || msgs[0].RFC822Size != int64(len(testMessage)) {
+		t.Errorf("first message: envelope = %+v, size = %v", msgs[0].Envelope, msgs[0].RFC822Size)
+	}
+	if b := msgs[0].FindBodySection(bodySection); string(b) != testMessage {
+		t.Errorf("BODY[] = %q, want %q", b, testMessage)
+	}
+
+	err = c.Store(imap.SeqSetNum(1), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Flags:  []imap.Flag{imap.FlagFlagged},
+		Silent: true,
+	}, nil).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := maildirpp.NewDir(root)
+	inboxMsgs, err := inbox.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flagged int
+	for _, msg := range inboxMsgs {
+		if msg.Flags().Has(maildirpp.FlagFlagged) {
+			flagged++
+		}
+	}
+	if flagged != 1 {
+		t.Errorf("%v flagged messages in the Maildir, want 1", flagged)
+	}
+
+	searchData, err := c.UIDSearch(&imap.SearchCriteria{
+		Flag:   []imap.Flag{imap.FlagFlagged},
+		Header: []imap.SearchCriteriaHeaderField{{Key: "Subject", Value: "hello"}},
+	}, nil).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids := searchData.AllUIDs(); !slices.Equal(uids, []imap.UID{1}) {
+		t.Errorf("UID SEARCH = %v, want [1]", uids)
+	}
+	for _, tc := range []struct {
+		criteria imap.SearchCriteria
+		want     []uint32
+	}{
+		{imap.SearchCriteria{Body: []string{"bob"}}, []uint32{1, 2}},
+		{imap.SearchCriteria{Text: []string{"alice"}, SeqNum: []imap.SeqSet{imap.SeqSetNum(2)}}, []uint32{2}},
+		{imap.SearchCriteria{Not: []imap.SearchCriteria{{Flag: []imap.Flag{imap.FlagSeen}}}}, []uint32{1}},
+		{imap.SearchCriteria{UID: []imap.UIDSet{{imap.UIDRange{Start: 1, Stop: 0}}}, Body: []string{"bob"}}, []uint32{1, 2}},
+		{imap.SearchCriteria{SeqNum: []imap.SeqSet{imap.SeqSetNum(3)}}, nil},
+		{imap.SearchCriteria{Flag: []imap.Flag{"$Important"}}, nil},
+		{imap.SearchCriteria{Since: time.Now().Add(24 * time.Hour)}, nil},
+	} {
+		searchData, err := c.Search(&tc.criteria, nil).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seqNums := searchData.AllSeqNums(); !slices.Equal(seqNums, tc.want) {
+			t.Errorf("SEARCH %+v = %v, want %v", tc.criteria, seqNums, tc.want)
+		}
+	}
+
+	copyData, err := c.Copy(imap.SeqSetNum(1), "Lists/Go").Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids, _ := copyData.DestUIDs.Nums(); !slices.Equal(uids, []imap.UID{1}) {
+		t.Errorf("COPY destination UIDs = %v, want [1]", uids)
+	}
+	moveData, err := c.Move(imap.SeqSetNum(2), "Lists/Go").Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uids, _ := moveData.DestUIDs.(imap.UIDSet).Nums(); !slices.Equal(uids, []imap.UID{2}) {
+		t.Errorf("MOVE destination UIDs = %v, want [2]", uids)
+	}
+	statusData, err := c.Status("Lists/Go", &imap.StatusOptions{NumMessages: true, NumUnseen: true}).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *statusData.NumMessages != 2 || *statusData.NumUnseen != 1 {
+		t.Errorf("STATUS = %v messages, %v unseen, want 2 and 1", *statusData.NumMessages, *statusData.NumUnseen)
+	}
+
+	err = c.Store(imap.SeqSetNum(1), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+		Silent: true,
+	}, nil).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expunged, err := c.Expunge().Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(expunged, []uint32{1}) {
+		t.Errorf("EXPUNGE = %v, want [1]", expunged)
+	}
+	if inboxMsgs, err := inbox.Messages(); err != nil {
+		t.Fatal(err)
+	} else if len(inboxMsgs) != 0 {
+		t.Errorf("%v messages left in the Maildir, want 0", len(inboxMsgs))
+	}
+}
+
+func TestServer_uids(t *testing.T) {
+	t.Parallel()
+	root := newTestRoot(t)
+	for _, s := range []string{"Subject: a\r\n\r\n", "Subject: b\r\n\r\n"} {
+		if err := maildirpp.Deliver(root, strings.NewReader(s), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fetchUIDs := func(c *imapclient.Client) (uint32, []imap.UID) {
+		t.Helper()
+		data, err := c.Select("INBOX", nil).Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := c.Fetch(imap.SeqSetNum(1, 2), &imap.FetchOptions{UID: true}).Collect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uids []imap.UID
+		for _, msg := range msgs {
+			uids = append(uids, msg.UID)
+		}
+		return data.UIDValidity, uids
+	}
+
+	uidValidity, uids := fetchUIDs(newTestServer(t, root, nil)(nil))
+	// the UIDs are stored in the Maildir
+	uidValidity2, uids2 := fetchUIDs(newTestServer(t, root, nil)(nil))
+	if uidValidity != uidValidity2 || !slices.Equal(uids, uids2) {
+		t.Errorf("UIDs changed across servers: %v %v, then %v %v", uidValidity, uids, uidValidity2, uids2)
+	}
+
+	// a UID list truncated by a crash is rebuilt with a new UIDVALIDITY
+	uidlist := filepath.Join(root, uidlistFilename)
+	b, err := os.ReadFile(uidlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	if err := os.WriteFile(uidlist, []byte(lines[0]+lines[1]+"1"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	uidValidity3, uids3 := fetchUIDs(newTestServer(t, root, nil)(nil))
+	if uidValidity3 == uidValidity || !slices.Equal(uids3, []imap.UID{1, 2}) {
+		t.Errorf("after truncation: UIDs %v %v, want a new UIDVALIDITY and [1 2]", uidValidity3, uids3)
+	}
+	uidValidity4, uids4 := fetchUIDs(newTestServer(t, root, nil)(nil))
+	if uidValidity4 != uidValidity3 || !slices.Equal(uids4, uids3) {
+		t.Errorf("rebuilt UIDs not stored: %v %v, then %v %v", uidValidity3, uids3, uidValidity4, uids4)
+	}
+}
+
+func TestServer_copyFailure(t *testing.T) {
+	t.Parallel()
+	root := newTestRoot(t)
+	if err := os.WriteFile(filepath.Join(root, "cur", "1.M1P1.host:2,"), []byte(testMessage), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// the second message cannot be read
+	if err := os.Mkdir(filepath.Join(root, "cur", "2.M2P1.host:2,"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, root, nil)(nil)
+	if err := c.Create("Archive", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Copy(imap.SeqSetNum(1, 2), "Archive").Wait(); err == nil {
+		t.Fatal("COPY succeeded with an unreadable message")
+	}
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(root, ".Archive", sub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%v messages left in Archive/%v after a failed COPY", len(entries), sub)
+		}
+	}
+}
+
+func TestServer_idle(t *testing.T) {
+	t.Parallel()
+	root := newTestRoot(t)
+	if err := maildirpp.Deliver(root, strings.NewReader(testMessage), nil); err != nil {
+		t.Fatal(err)
+	}
+	dial := newTestServer(t, root, &Options{IdleInterval: 10 * time.Millisecond})
+
+	exists := make(chan uint32, 16)
+	expunges := make(chan uint32, 16)
+	fetches := make(chan []imap.Flag, 16)
+	idler := dial(&imapclient.Options{
+		UnilateralDataHandler: &imapclient.UnilateralDataHandler{
+			Mailbox: func(data *imapclient.UnilateralDataMailbox) {
+				if data.NumMessages != nil {
+					exists <- *data.NumMessages
+				}
+			},
+			Expunge: func(seqNum uint32) {
+				expunges <- seqNum
+			},
+			Fetch: func(msg *imapclient.FetchMessageData) {
+				buf, err := msg.Collect()
+				if err == nil {
+					fetches <- buf.Flags
+				}
+			},
+		},
+	})
+	if _, err := idler.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	idleCmd, err := idler.Idle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleCmd.Close()
+
+	wait := func(ch <-chan uint32, want uint32) {
+		t.Helper()
+		select {
+		case n := <-ch:
+			if n != want {
+				t.Errorf("got %v, want %v", n, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for an update")
+		}
+	}
+
+	// delivered by another program
+	if err := maildirpp.Deliver(root, strings.NewReader(testMessage), nil); err != nil {
+		t.Fatal(err)
+	}
+	wait(exists, 2)
+
+	// changed by another session
+	c := dial(nil)
+	if _, err := c.Select("INBOX", nil).Wait(); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Store(imap.SeqSetNum(1), &imap.StoreFlags{
+		Op:     imap.StoreFlagsAdd,
+		Flags:  []imap.Flag{imap.FlagDeleted},
+		Silent: true,
+	}, nil).Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case flags := <-fetches:
+		if !slices.Equal(flags, []imap.Flag{imap.FlagDeleted}) {
+			t.Errorf("flags = %v, want %v", flags, imap.FlagDeleted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for flags")
+	}
+	if err := c.Expunge().Close(); err != nil {
+		t.Fatal(err)
+	}
+	wait(expunges, 1)
+}
+
+func TestMailbox_refreshThrottled(t *testing.T) {
+	t.Parallel()
+	root := newTestRoot(t)
+	old := time.Now().Add(-time.Hour)
+	setMtimes := func() {
+		t.Helper()
+		for _, sub := range []string{"new", "cur"} {
+			if err := os.Chtimes(filepath.Join(root, sub), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	setMtimes()
+	mbox, err := openMailbox(root, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := maildirpp.Deliver(root, strings.NewReader("Subject: a\r\n\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// the directories look unchanged
+	setMtimes()
+	mbox.mutex.Lock()
+	err = mbox.refreshLocked()
+	n := len(mbox.l)
+	mbox.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("refresh with unchanged directories found %v messages, want 0", n)
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(root, "new"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	mbox.mutex.Lock()
+	err = mbox.refreshLocked()
+	n = len(mbox.l)
+	mbox.mutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("refresh found %v messages, want 1", n)
+	}
+}
@@ -0,0 +1,190 @@
+package imapmaildir
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// session is an IMAP session. The user is nil until the client logs in, and
+// the mailbox view is nil if no mailbox is selected.
+type session struct {
+	*user
+	*mailboxView
+
+	server *Server // immutable
+}
+
+var _ imapserver.SessionIMAP4rev2 = (*session)(nil)
+
+func (sess *session) Login(username, password string) error {
+	root, err := sess.server.authenticate(username, password)
+	if err != nil {
+		return imapserver.ErrAuthFailed
+	}
+	sess.user = sess.server.user(root)
+	return nil
+}
+
+func (sess *session) Close() error {
+	if sess.mailboxView != nil {
+		sess.mailboxView.close()
+		sess.mailboxView = nil
+	}
+	return nil
+}
+
+func (sess *session) Select(name string, options *imap.SelectOptions) (*imap.SelectData, error) {
+	mbox, err := sess.user.mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	if sess.mailboxView != nil {
+		sess.mailboxView.close()
+		sess.mailboxView = nil
+	}
+
+	mbox.mutex.Lock()
+	defer mbox.mutex.Unlock()
+	if err := mbox.refreshLocked(); err != nil {
+		return nil, err
+	}
+	sess.mailboxView = mbox.newViewLocked(options.ReadOnly)
+	return mbox.selectDataLocked(options.ReadOnly), nil
+}
+
+func (sess *session) Unselect() error {
+	sess.mailboxView.close()
+	sess.mailboxView = nil
+	return nil
+}
+
+func (sess *session) destination(name string) (*mailbox, error) {
+	dest, err := sess.user.mailbox(name)
+	if err != nil {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTryCreate,
+			Text: "No such mailbox",
+		}
+	}
+	return dest, nil
+}
+
+// Copy copies messages with Message.CopyTo. If a copy fails, the copies
+// already made are removed.
+func (sess *session) Copy(numSet imap.NumSet, destName string) (*imap.CopyData, error) {
+	dest, err := sess.destination(destName)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, uids, err := sess.mailboxView.messages(numSet)
+	if err != nil {
+		return nil, err
+	}
+	var sourceUIDs imap.UIDSet
+	sourceUIDs.AddNum(uids...)
+	copies := make([]*maildirpp.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		c, err := msg.CopyTo(dest.dir.Dir)
+		if err != nil {
+			// COPY is all or nothing: remove the copies already made
+			for _, c := range copies {
+				c.Remove()
+			}
+			return nil, err
+		}
+		copies = append(copies, c)
+	}
+
+	dest.mutex.Lock()
+	destUIDs, err := dest.addLocked(copies...)
+	dest.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &imap.CopyData{
+		UIDValidity: dest.uidValidity,
+		SourceUIDs:  sourceUIDs,
+		DestUIDs:    destUIDs,
+	}, nil
+}
+
+// Move moves messages with Message.MoveTo. The EXPUNGE responses are written
+// by the next poll.
+func (sess *session) Move(w *imapserver.MoveWriter, numSet imap.NumSet, destName string) error {
+	view := sess.mailboxView
+	if view.readOnly {
+		return errReadOnly
+	}
+	dest, err := sess.destination(destName)
+	if err != nil {
+		return err
+	} else if dest == view.mailbox {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Text: "Source and destination mailboxes are identical",
+		}
+	}
+
+	msgs, uids, err := view.messages(numSet)
+	if err != nil {
+		return err
+	}
+	// the source UIDs are those of the messages actually moved, even if a
+	// refresh expunges them meanwhile
+	var (
+		moved      []*maildirpp.Message
+		sourceUIDs imap.UIDSet
+		keys       = make(map[string]struct{})
+		moveErr    error
+	)
+	for i, msg := range msgs {
+		key := msg.Key()
+		m, err := msg.MoveTo(dest.dir.Dir)
+		if err != nil {
+			moveErr = err
+			break
+		}
+		moved = append(moved, m)
+		sourceUIDs.AddNum(uids[i])
+		keys[key] = struct{}{}
+	}
+
+	// register the messages moved before a failure too
+	dest.mutex.Lock()
+	destUIDs, addErr := dest.addLocked(moved...)
+	dest.mutex.Unlock()
+
+	view.mutex.Lock()
+	view.expungeLocked(keys)
+	saveErr := view.saveLocked()
+	view.mutex.Unlock()
+
+	if err := errors.Join(moveErr, addErr, saveErr); err != nil {
+		return err
+	}
+	return w.WriteCopyData(&imap.CopyData{
+		UIDValidity: dest.uidValidity,
+		SourceUIDs:  sourceUIDs,
+		DestUIDs:    destUIDs,
+	})
+}
+
+func (sess *session) Poll(w *imapserver.UpdateWriter, allowExpunge bool) error {
+	if sess.mailboxView == nil {
+		return nil
+	}
+	return sess.mailboxView.Poll(w, allowExpunge)
+}
+
+func (sess *session) Idle(w *imapserver.UpdateWriter, stop <-chan struct{}) error {
+	if sess.mailboxView == nil {
+		return nil
+	}
+	return sess.mailboxView.Idle(w, stop, sess.server.idleInterval)
+}
@@ -0,0 +1,456 @@
+package imapmaildir
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap/v2"
+	"github.com/emersion/go-imap/v2/imapserver"
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+const mailboxDelim rune = '/'
+
+// subscriptionsFilename is the name of the file listing the subscribed
+// mailboxes, one per line, in the root directory.
+const subscriptionsFilename = "subscriptions"
+
+var errNoSuchMailbox = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeNonExistent,
+	Text: "No such mailbox",
+}
+
+var errMailboxExists = &imap.Error{
+	Type: imap.StatusResponseTypeNo,
+	Code: imap.ResponseCodeAlreadyExists,
+	Text: "Mailbox already exists",
+}
+
+// user is the Maildir++ hierarchy of a user.
+type user struct {
+	root string
+
+	mutex           sync.Mutex
+	mailboxes       map[string]*mailbox // by path, loaded on demand
+	prevUIDValidity uint32
+}
+
+func newUser(root string) *user {
+	return &user{
+		root:      root,
+		mailboxes: make(map[string]*mailbox),
+	}
+}
+
+func isInbox(name string) bool {
+	return strings.EqualFold(name, "INBOX")
+}
+
+func canonicalName(name string) string {
+	if isInbox(name) {
+		return "INBOX"
+	}
+	return name
+}
+
+// folder returns the Maildir++ folder name of a mailbox other than INBOX.
+func folder(name string) (string, error) {
+	elems := strings.Split(name, string(mailboxDelim))
+	if slices.Contains(elems, "") {
+		return "", &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Invalid mailbox name",
+		}
+	}
+	key, err := maildirpp.Join(elems)
+	if err != nil {
+		return "", &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "Mailbox names cannot contain dots",
+		}
+	}
+	return key, nil
+}
+
+// path returns the path to the Maildir of a mailbox.
+func (u *user) path(name string) (string, error) {
+	if isInbox(name) {
+		return u.root, nil
+	}
+	key, err := folder(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.root, key), nil
+}
+
+func isMaildir(path string) bool {
+	fi, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && fi.IsDir()
+}
+
+// newUIDValidityLocked returns a UIDVALIDITY value never returned before.
+// It must change when a mailbox is deleted and created again.
+func (u *user) newUIDValidityLocked() uint32 {
+	v := uint32(time.Now().Unix())
+	if v <= u.prevUIDValidity {
+		v = u.prevUIDValidity + 1
+	}
+	u.prevUIDValidity = v
+	return v
+}
+
+func (u *user) mailbox(name string) (*mailbox, error) {
+	path, err := u.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if mbox := u.mailboxes[path]; mbox != nil {
+		return mbox, nil
+	}
+	if !isMaildir(path) {
+		return nil, errNoSuchMailbox
+	}
+	mbox, err := openMailbox(path, u.newUIDValidityLocked())
+	if err != nil {
+		return nil, err
+	}
+	u.mailboxes[path] = mbox
+	return mbox, nil
+}
+
+// names returns the names of all the mailboxes, sorted.
+func (u *user) names() ([]string, error) {
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{"INBOX"}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		elems, err := maildirpp.Split(entry.Name())
+		if err != nil || slices.Contains(elems, "") {
+			continue
+		}
+		if !isMaildir(filepath.Join(u.root, entry.Name())) {
+			continue
+		}
+		names = append(names, strings.Join(elems, string(mailboxDelim)))
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (u *user) List(w *imapserver.ListWriter, ref string, patterns []string, options *imap.ListOptions) error {
+	if len(patterns) == 0 {
+		return w.WriteList(&imap.ListData{
+			Attrs: []imap.MailboxAttr{imap.MailboxAttrNoSelect},
+			Delim: mailboxDelim,
+		})
+	}
+
+	names, err := u.names()
+	if err != nil {
+		return err
+	}
+	subscribed, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		match := false
+		for _, pattern := range patterns {
+			match = imapserver.MatchList(name, mailboxDelim, ref, pattern)
+			if match {
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+
+		_, isSubscribed := subscribed[name]
+		if options.SelectSubscribed && !isSubscribed {
+			continue
+		}
+		if options.SelectSpecialUse {
+			continue
+		}
+
+		data := imap.ListData{
+			Mailbox: name,
+			Delim:   mailboxDelim,
+		}
+		if isSubscribed {
+			data.Attrs = append(data.Attrs, imap.MailboxAttrSubscribed)
+		}
+		if options.ReturnChildren {
+			prefix := name + string(mailboxDelim)
+			hasChildren := slices.ContainsFunc(names, func(other string) bool {
+				return strings.HasPrefix(other, prefix)
+			})
+			if hasChildren {
+				data.Attrs = append(data.Attrs, imap.MailboxAttrHasChildren)
+			} else {
+				data.Attrs = append(data.Attrs, imap.MailboxAttrHasNoChildren)
+			}
+		}
+		if options.ReturnStatus != nil {
+			mbox, err := u.mailbox(name)
+			if err != nil {
+				return err
+			}
+			data.Status, err = mbox.status(name, options.ReturnStatus)
+			if err != nil {
+				return err
+			}
+		}
+		if err := w.WriteList(&data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *user) Status(name string, options *imap.StatusOptions) (*imap.StatusData, error) {
+	mbox, err := u.mailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return mbox.status(canonicalName(name), options)
+}
+
+func (u *user) Append(name string, r imap.LiteralReader, options *imap.AppendOptions) (*imap.AppendData, error) {
+	mbox, err := u.mailbox(name)
+	if err != nil {
+		return nil, &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeTryCreate,
+			Text: "No such mailbox",
+		}
+	}
+	return mbox.appendLiteral(r, options)
+}
+
+func (u *user) Create(name string, options *imap.CreateOptions) error {
+	name = strings.TrimRight(name, string(mailboxDelim))
+	if isInbox(name) {
+		return errMailboxExists
+	}
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return errMailboxExists
+	}
+	if err := maildirpp.NewDir(path).Init(); err != nil {
+		return err
+	}
+	// marks a Maildir++ folder, for delivery agents
+	return os.WriteFile(filepath.Join(path, "maildirfolder"), nil, 0600)
+}
+
+func (u *user) Delete(name string) error {
+	if isInbox(name) {
+		return &imap.Error{
+			Type: imap.StatusResponseTypeNo,
+			Code: imap.ResponseCodeCannot,
+			Text: "INBOX cannot be deleted",
+		}
+	}
+	path, err := u.path(name)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !isMaildir(path) {
+		return errNoSuchMailbox
+	}
+	delete(u.mailboxes, path)
+	return os.RemoveAll(path)
+}
+
+// Rename renames a mailbox and its inferiors. Renaming INBOX moves its
+// messages to the new mailbox instead.
+func (u *user) Rename(oldName, newName string, options *imap.RenameOptions) error {
+	newName = strings.TrimRight(newName, string(mailboxDelim))
+	if isInbox(newName) {
+		return errMailboxExists
+	}
+	oldPath, err := u.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := u.path(newName)
+	if err != nil {
+		return err
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !isMaildir(oldPath) {
+		return errNoSuchMailbox
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return errMailboxExists
+	}
+
+	if isInbox(oldName) {
+		return u.moveInboxLocked(newPath)
+	}
+
+	oldFolder := filepath.Base(oldPath)
+	newFolder := filepath.Base(newPath)
+	entries, err := os.ReadDir(u.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name != oldFolder && !strings.HasPrefix(name, oldFolder+".") {
+			continue
+		}
+		from := filepath.Join(u.root, name)
+		to := filepath.Join(u.root, newFolder+strings.TrimPrefix(name, oldFolder))
+		if err := os.Rename(from, to); err != nil {
+			return err
+		}
+		delete(u.mailboxes, from)
+	}
+	return nil
+}
+
+// moveInboxLocked creates a new mailbox and moves the messages of INBOX to it.
+func (u *user) moveInboxLocked(path string) error {
+	target := maildirpp.NewDir(path)
+	if err := target.Init(); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(path, "maildirfolder"), nil, 0600); err != nil {
+		return err
+	}
+
+	inbox := maildirpp.NewDir(u.root)
+	if _, err := inbox.Unseen(); err != nil {
+		return err
+	}
+	msgs, err := inbox.Messages()
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if _, err := msg.MoveTo(target.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subscriptions returns the set of subscribed mailboxes.
+func (u *user) subscriptions() (map[string]struct{}, error) {
+	b, err := os.ReadFile(filepath.Join(u.root, subscriptionsFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return make(map[string]struct{}), nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if name := scanner.Text(); name != "" {
+			m[name] = struct{}{}
+		}
+	}
+	return m, scanner.Err()
+}
+
+func (u *user) setSubscribed(name string, subscribed bool) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	m, err := u.subscriptions()
+	if err != nil {
+		return err
+	}
+	if subscribed {
+		m[name] = struct{}{}
+	} else {
+		delete(m, name)
+	}
+
+	var buf bytes.Buffer
+	for _, name := range slices.Sorted(maps.Keys(m)) {
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+	return writeFile(u.root, subscriptionsFilename, buf.Bytes())
+}
+
+func (u *user) Subscribe(name string) error {
+	if _, err := u.mailbox(name); err != nil {
+		return err
+	}
+	return u.setSubscribed(canonicalName(name), true)
+}
+
+func (u *user) Unsubscribe(name string) error {
+	return u.setSubscribed(canonicalName(name), false)
+}
+
+func (u *user) Namespace() (*imap.NamespaceData, error) {
+	return &imap.NamespaceData{
+		Personal: []imap.NamespaceDescriptor{{Delim: mailboxDelim}},
+	}, nil
+}
+
+// writeFile replaces a file in a Maildir atomically, by writing it to the tmp
+// directory and syncing it to disk first.
+func writeFile(dir, name string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Join(dir, "tmp"), name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"io"
+	"os"
+)
+
+// Append inserts a new message into the Maildir, with the content read from
+// r, and returns it once committed.
+//
+// If an error occurs, the temporary file is removed and the message is not
+// inserted.
+func (d Dir) Append(r io.Reader, flags []Flag, attrs Attributes, opts *CreateOptions, dynAttrs ...DynAttribute) (*Message, error) {
+	tmp, err := d.create(flags, attrs, opts, dynAttrs...)
+	if err != nil {
+		return nil, err
+	}
+	tmpFilename := tmp.file.Name()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.file.Close()
+		os.Remove(tmpFilename)
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return nil, err
+	}
+	return tmp.msg, nil
+}
+
+// Deliver delivers a new message to the Maildir d, with the content read from
+// r.
+//
+// If an error occurs, the temporary file is removed and the message is not
+// delivered.
+func Deliver(d string, r io.Reader, attrs Attributes, dynAttrs ...DynAttribute) error {
+	del, err := NewDelivery(d, attrs, dynAttrs...)
+	if err != nil {
+		return err
+	}
+	tmpFilename := del.file.Name()
+
+	if _, err := io.Copy(del, r); err != nil {
+		del.Abort()
+		return err
+	}
+	if err := del.Close(); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return nil
+}
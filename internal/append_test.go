@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader returns its content, then fails.
+type failingReader struct {
+	r io.Reader
+}
+
+var errFailingReader = errors.New("reader failed")
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		return n, errFailingReader
+	}
+	return n, err
+}
+
+// checkEmpty fails if the directory is not empty.
+func checkEmpty(t *testing.T, path string) {
+	t.Helper()
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left in %s", len(entries), path)
+	}
+}
+
+func TestDir_Append(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const text = "an appended message"
+	date := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	msg, err := d.Append(strings.NewReader(text), []Flag{FlagSeen}, Attributes{"A": "1"},
+		&CreateOptions{InternalDate: date}, &byteCountsAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(msg.Key(), ",A=1,C=19") {
+		t.Errorf("Message.Key() = %q, missing attributes", msg.Key())
+	}
+	found, err := d.MessageByKey(msg.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Filename() != msg.Filename() {
+		t.Errorf("Message.Filename() = %q, want %q", msg.Filename(), found.Filename())
+	}
+	if !slices.Equal(found.Flags(), Flags{FlagSeen}) {
+		t.Errorf("Message.Flags() = %v, want {FlagSeen}", found.Flags())
+	}
+	if cat(t, msg.Filename()) != text {
+		t.Error("content doesn't match")
+	}
+	if got, err := msg.InternalDate(); err != nil || !got.Equal(date) {
+		t.Errorf("InternalDate() = %v, %v, want %v", got, err, date)
+	}
+	checkEmpty(t, filepath.Join(string(d), "tmp"))
+
+	_, err = d.Append(&failingReader{strings.NewReader(text)}, nil, nil, nil)
+	if !errors.Is(err, errFailingReader) {
+		t.Errorf("Append() = %v, want %v", err, errFailingReader)
+	}
+	checkEmpty(t, filepath.Join(string(d), "tmp"))
+	if msgs, err := d.Messages(); err != nil || len(msgs) != 1 {
+		t.Errorf("Messages() = %v, %v, want a single message", msgs, err)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const text = "a delivered message"
+	if err := Deliver(string(d), strings.NewReader(text), nil); err != nil {
+		t.Fatal(err)
+	}
+	err := Deliver(string(d), &failingReader{strings.NewReader(text)}, nil)
+	if !errors.Is(err, errFailingReader) {
+		t.Errorf("Deliver() = %v, want %v", err, errFailingReader)
+	}
+	checkEmpty(t, filepath.Join(string(d), "tmp"))
+
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Unseen() returned %d messages, want 1", len(msgs))
+	}
+	if cat(t, msgs[0].Filename()) != text {
+		t.Error("content doesn't match")
+	}
+}
@@ -0,0 +1,425 @@
+package internal
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// cacheFilename is the name of the cache file, in the Maildir directory.
+const cacheFilename = "maildir.cache"
+
+// cacheVersion is the version of the cache file format. Cache files with
+// another version are discarded.
+const cacheVersion = 1
+
+// cachedHeaderFields are the header fields stored in the cache: the fields of
+// the IMAP envelope, and the ones used to sort and thread messages.
+var cachedHeaderFields = []string{
+	"Date",
+	"Subject",
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Bcc",
+	"In-Reply-To",
+	"Message-Id",
+	"References",
+	"Content-Type",
+}
+
+// Cache stores the metadata of the messages of a Dir: envelope header fields,
+// sizes, internal dates and MIME structures. It avoids parsing message files
+// again, e.g. every time a folder is listed.
+//
+// The messages returned by the Cache methods fill it lazily, when their
+// Header, Entity, Size or InternalDate methods are called. The cache is only
+// written to disk by Save.
+//
+// Only a single process should use the cache of a Dir, like for the other Dir
+// operations. Concurrent deliveries are fine: new messages are simply not in
+// the cache yet. A Cache is safe for concurrent use.
+type Cache struct {
+	dir Dir
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	dirty   bool
+}
+
+type cacheEntry struct {
+	// Raw header fields, in the order of textproto.Header.Fields.
+	Fields     [][]byte
+	BodyOffset int64
+	HasHeader  bool
+
+	Size    int64
+	HasSize bool
+
+	InternalDate time.Time
+
+	Structure *cachedEntity
+}
+
+// cachedEntity is the serializable form of an Entity.
+type cachedEntity struct {
+	Path              []int
+	Fields            [][]byte
+	MediaType         string
+	Params            map[string]string
+	Encoding          string
+	Disposition       string
+	DispositionParams map[string]string
+	Size              int64
+	Lines             int64
+	Children          []*cachedEntity
+	Message           *cachedEntity
+}
+
+type cacheFile struct {
+	Version int
+	Entries map[string]*cacheEntry
+}
+
+// OpenCache opens the cache of the Maildir. If there is no cache file yet, or
+// if it cannot be decoded, an empty cache is returned.
+func (d Dir) OpenCache() (*Cache, error) {
+	c := &Cache{
+		dir:     d,
+		entries: make(map[string]*cacheEntry),
+	}
+
+	f, err := os.Open(filepath.Join(string(d), cacheFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cf cacheFile
+	if err := gob.NewDecoder(f).Decode(&cf); err != nil || cf.Version != cacheVersion {
+		// the cache can always be rebuilt from the messages
+		c.dirty = true
+		return c, nil
+	}
+	if cf.Entries != nil {
+		c.entries = cf.Entries
+	}
+	return c, nil
+}
+
+// Save writes the cache to disk, dropping the entries of the messages which
+// are not in cur anymore.
+//
+// The cache file is replaced atomically.
+func (c *Cache) Save() error {
+	keys, err := walkKeys(c.dir)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.entries {
+		if _, ok := keys[key]; !ok {
+			delete(c.entries, key)
+			c.dirty = true
+		}
+	}
+	if !c.dirty {
+		return nil
+	}
+
+	tmpKey, err := newKey(nil)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filepath.Join(string(c.dir), "tmp", tmpKey)
+	err = writeFile(tmpFilename, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(&cacheFile{
+			Version: cacheVersion,
+			Entries: c.entries,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, filepath.Join(string(c.dir), cacheFilename)); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Walk calls fn for every message, like Dir.Walk. The messages use the cache.
+func (c *Cache) Walk(fn func(*Message) error) error {
+	return c.dir.Walk(func(msg *Message) error {
+		msg.cache = c
+		return fn(msg)
+	})
+}
+
+// Messages returns a list of all messages in cur, like Dir.Messages. The
+// messages use the cache.
+func (c *Cache) Messages() ([]*Message, error) {
+	var msgs []*Message
+	err := c.Walk(func(msg *Message) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	return msgs, err
+}
+
+// MessageByKey finds a message by key, like Dir.MessageByKey. The message
+// uses the cache.
+func (c *Cache) MessageByKey(key string) (*Message, error) {
+	msg, err := c.dir.MessageByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	msg.cache = c
+	return msg, nil
+}
+
+// Message returns msg, using the cache. The message must belong to the Dir of
+// the cache.
+func (c *Cache) Message(msg *Message) *Message {
+	msg.cache = c
+	return msg
+}
+
+// entry returns the cache entry for the message with the given key, and
+// creates it if needed. c.mu must be held.
+func (c *Cache) entry(key string) *cacheEntry {
+	e, ok := c.entries[key]
+	if !ok {
+		e = new(cacheEntry)
+		c.entries[key] = e
+	}
+	return e
+}
+
+// invalidate drops the cache entry for the message with the given key.
+func (c *Cache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		delete(c.entries, key)
+		c.dirty = true
+	}
+}
+
+func (c *Cache) header(msg *Message) (*Header, error) {
+	key := msg.Key()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.HasHeader {
+		h := &Header{
+			Header:     mail.Header{Header: message.Header{Header: headerFromFields(e.Fields)}},
+			BodyOffset: e.BodyOffset,
+		}
+		c.mu.Unlock()
+		return h, nil
+	}
+	c.mu.Unlock()
+
+	h, err := msg.readHeader()
+	if err != nil {
+		return nil, err
+	}
+	var fields [][]byte
+	for hf := h.Fields(); hf.Next(); {
+		if !isCachedHeaderField(hf.Key()) {
+			continue
+		}
+		raw, err := hf.Raw()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, raw)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(key)
+	e.Fields = fields
+	e.BodyOffset = h.BodyOffset
+	e.HasHeader = true
+	c.dirty = true
+	return &Header{
+		Header:     mail.Header{Header: message.Header{Header: headerFromFields(fields)}},
+		BodyOffset: h.BodyOffset,
+	}, nil
+}
+
+func (c *Cache) size(msg *Message) (int64, error) {
+	key := msg.Key()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.HasSize {
+		c.mu.Unlock()
+		return e.Size, nil
+	}
+	c.mu.Unlock()
+
+	size, err := msg.size()
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(key)
+	e.Size = size
+	e.HasSize = true
+	c.dirty = true
+	return size, nil
+}
+
+func (c *Cache) internalDate(msg *Message) (time.Time, error) {
+	key := msg.Key()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && !e.InternalDate.IsZero() {
+		c.mu.Unlock()
+		return e.InternalDate, nil
+	}
+	c.mu.Unlock()
+
+	fi, err := msg.stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entry(key)
+	e.InternalDate = fi.ModTime()
+	if !e.HasSize {
+		e.Size = fi.Size()
+		e.HasSize = true
+	}
+	c.dirty = true
+	return e.InternalDate, nil
+}
+
+func (c *Cache) entity(msg *Message) (*Entity, error) {
+	key := msg.Key()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.Structure != nil {
+		entity := e.Structure.entity()
+		c.mu.Unlock()
+		return entity, nil
+	}
+	c.mu.Unlock()
+
+	entity, err := msg.readEntity()
+	if err != nil {
+		return nil, err
+	}
+	structure, err := newCachedEntity(entity)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(key).Structure = structure
+	c.dirty = true
+	return entity, nil
+}
+
+func isCachedHeaderField(k string) bool {
+	for _, f := range cachedHeaderFields {
+		if strings.EqualFold(k, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFromFields builds a header from raw fields, in the order of
+// textproto.Header.Fields.
+func headerFromFields(fields [][]byte) textproto.Header {
+	var h textproto.Header
+	for i := len(fields) - 1; i >= 0; i-- {
+		h.AddRaw(fields[i])
+	}
+	return h
+}
+
+// newCachedEntity converts an Entity to its serializable form. Only the
+// Content-* and envelope header fields are kept.
+func newCachedEntity(e *Entity) (*cachedEntity, error) {
+	var fields [][]byte
+	for hf := e.Header.Fields(); hf.Next(); {
+		k := hf.Key()
+		if !isCachedHeaderField(k) && !strings.HasPrefix(strings.ToLower(k), "content-") {
+			continue
+		}
+		raw, err := hf.Raw()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, raw)
+	}
+	ce := &cachedEntity{
+		Path:              e.Path,
+		Fields:            fields,
+		MediaType:         e.MediaType,
+		Params:            e.Params,
+		Encoding:          e.Encoding,
+		Disposition:       e.Disposition,
+		DispositionParams: e.DispositionParams,
+		Size:              e.Size,
+		Lines:             e.Lines,
+	}
+	for _, child := range e.Children {
+		cc, err := newCachedEntity(child)
+		if err != nil {
+			return nil, err
+		}
+		ce.Children = append(ce.Children, cc)
+	}
+	if e.Message != nil {
+		cm, err := newCachedEntity(e.Message)
+		if err != nil {
+			return nil, err
+		}
+		ce.Message = cm
+	}
+	return ce, nil
+}
+
+func (ce *cachedEntity) entity() *Entity {
+	e := &Entity{
+		Path:              ce.Path,
+		Header:            message.Header{Header: headerFromFields(ce.Fields)},
+		MediaType:         ce.MediaType,
+		Params:            ce.Params,
+		Encoding:          ce.Encoding,
+		Disposition:       ce.Disposition,
+		DispositionParams: ce.DispositionParams,
+		Size:              ce.Size,
+		Lines:             ce.Lines,
+	}
+	for _, child := range ce.Children {
+		e.Children = append(e.Children, child.entity())
+	}
+	if ce.Message != nil {
+		e.Message = ce.Message.entity()
+	}
+	return e
+}
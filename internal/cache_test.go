@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const header = "Received: from somewhere\r\n" +
+		"Subject: Cached\r\n" +
+		"From: someone@example.org\r\n" +
+		"\r\n"
+	date := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	appended, err := d.Append(strings.NewReader(header+"the body\r\n"), nil, nil, &CreateOptions{InternalDate: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := d.Append(strings.NewReader(mimeTestMessage), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := d.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs {
+		if _, err := msg.Header(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.Size(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.InternalDate(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.Entity(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the next reads come from the cache: the content is gone
+	if err := os.Truncate(appended.Filename(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := removed.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = d.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 2 {
+		t.Fatalf("cache has %d entries, want 2", len(c.entries))
+	}
+	msg, err := c.MessageByKey(appended.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := msg.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, err := h.Subject(); err != nil || subject != "Cached" {
+		t.Errorf("Subject() = %q, %v, want %q", subject, err, "Cached")
+	}
+	if h.Get("From") != "someone@example.org" {
+		t.Errorf("From = %q", h.Get("From"))
+	}
+	if h.Has("Received") {
+		t.Error("non-envelope field was cached")
+	}
+	if h.BodyOffset != int64(len(header)) {
+		t.Errorf("BodyOffset = %d, want %d", h.BodyOffset, len(header))
+	}
+	if size, err := msg.Size(); err != nil || size != int64(len(header+"the body\r\n")) {
+		t.Errorf("Size() = %d, %v", size, err)
+	}
+	if got, err := msg.InternalDate(); err != nil || !got.Equal(date) {
+		t.Errorf("InternalDate() = %v, %v, want %v", got, err, date)
+	}
+	e, err := msg.Entity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.MediaType != "text/plain" || e.Size != int64(len("the body\r\n")) {
+		t.Errorf("unexpected cached entity: %q, size %d", e.MediaType, e.Size)
+	}
+
+	// the entry of the removed message is dropped on save
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 1 {
+		t.Errorf("cache has %d entries after Save, want 1", len(c.entries))
+	}
+	if _, err := os.Stat(filepath.Join(string(d), cacheFilename)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCache_corrupted(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(string(d), cacheFilename), []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.entries) != 0 {
+		t.Errorf("cache has %d entries, want 0", len(c.entries))
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.OpenCache(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// CopyStrategy is the way Message.CopyToWithOptions copies the content of a message.
+type CopyStrategy int
+
+const (
+	// Try CopyLink, then CopyClone, then CopyStream.
+	CopyAuto CopyStrategy = iota
+	// Hard link the message file. Both messages share the same content and
+	// modification time. This only works on the same filesystem.
+	CopyLink
+	// Clone the message file with FICLONE, or copy it in the kernel with
+	// copy_file_range. This is only supported on Linux.
+	CopyClone
+	// Stream the content of the message file into a new file.
+	CopyStream
+)
+
+// CopyOptions contains options for Message.CopyToWithOptions.
+type CopyOptions struct {
+	Strategy CopyStrategy
+}
+
+// copy copies the file src to dst, going through tmp when a new file has to
+// be written.
+func (s CopyStrategy) copy(src, tmp, dst string) error {
+	switch s {
+	case CopyLink:
+		return os.Link(src, dst)
+	case CopyClone:
+		return copyThroughTmp(src, tmp, dst, cloneFile)
+	case CopyStream:
+		return copyThroughTmp(src, tmp, dst, streamFile)
+	}
+
+	var err error
+	for _, s := range []CopyStrategy{CopyLink, CopyClone, CopyStream} {
+		err = s.copy(src, tmp, dst)
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	return err
+}
+
+// copyThroughTmp copies src to tmp with copyContent, then renames tmp to dst.
+func copyThroughTmp(src, tmp, dst string, copyContent func(out, in *os.File) error) error {
+	if err := copyFile(src, tmp, copyContent); err != nil {
+		return err
+	}
+	if err := renameNoReplace(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// linkRename renames oldpath to newpath by hard linking it and removing
+// oldpath, so that an existing newpath is never replaced.
+func linkRename(oldpath, newpath string) error {
+	if err := os.Link(oldpath, newpath); err != nil {
+		return err
+	}
+	return os.Remove(oldpath)
+}
+
+// copyFile copies src to the new file dst with copyContent and syncs it to
+// disk. The modification time of src is preserved. On failure, dst is removed.
+func copyFile(src, dst string, copyContent func(out, in *os.File) error) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(dst)
+		}
+	}()
+
+	if err = copyContent(out, in); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, time.Time{}, fi.ModTime())
+}
+
+// streamFile copies the content of in to out.
+func streamFile(out, in *os.File) error {
+	_, err := io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package internal
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes out share the content of in with FICLONE, falling back to
+// an in-kernel copy with copy_file_range.
+func cloneFile(out, in *os.File) error {
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err == nil {
+		return nil
+	}
+
+	for {
+		n, err := unix.CopyFileRange(int(in.Fd()), nil, int(out.Fd()), nil, 1<<30, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is only supported on Linux.
+func cloneFile(out, in *os.File) error {
+	return errors.ErrUnsupported
+}
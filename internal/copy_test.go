@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+)
+
+func TestCopyStrategies(t *testing.T) {
+	t.Parallel()
+	src := Dir(filepath.Join(t.TempDir(), "src"))
+	if err := src.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const text = "a message with a large attachment"
+	makeDelivery(t, src, text, Attributes{"S": "33"})
+	msgs, err := src.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := msgs[0]
+	if err := msg.SetFlags([]Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+
+	strategies := map[string]CopyStrategy{
+		"auto":   CopyAuto,
+		"link":   CopyLink,
+		"clone":  CopyClone,
+		"stream": CopyStream,
+	}
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			target := Dir(filepath.Join(t.TempDir(), name))
+			if err := target.Init(); err != nil {
+				t.Fatal(err)
+			}
+
+			copied, err := msg.CopyToWithOptions(target, &CopyOptions{Strategy: strategy})
+			if strategy == CopyClone && runtime.GOOS != "linux" {
+				if !errors.Is(err, errors.ErrUnsupported) {
+					t.Fatalf("want errors.ErrUnsupported, but CopyToWithOptions() = %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			if copied.Key() == msg.Key() {
+				t.Error("copied message has the same key")
+			}
+			found, err := target.MessageByKey(copied.Key())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.Filename() != copied.Filename() {
+				t.Errorf("copied filename = %q, want %q", copied.Filename(), found.Filename())
+			}
+			if !slices.Equal(found.Flags(), Flags{FlagSeen}) {
+				t.Errorf("copied flags = %v, want {FlagSeen}", found.Flags())
+			}
+			if cat(t, copied.Filename()) != text {
+				t.Error("target content doesn't match source")
+			}
+
+			fi1, err := os.Stat(msg.Filename())
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi2, err := os.Stat(copied.Filename())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if linked := os.SameFile(fi1, fi2); linked != (strategy == CopyLink || strategy == CopyAuto) {
+				t.Errorf("os.SameFile() = %v for strategy %q", linked, name)
+			}
+
+			// changing the flags of the copy must not affect the original
+			if err := copied.SetFlags([]Flag{FlagFlagged}); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(msg.Filename()) {
+				t.Error("original message was renamed")
+			}
+		})
+	}
+}
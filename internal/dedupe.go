@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// DuplicateOptions contains options for Dir.FindDuplicates.
+type DuplicateOptions struct {
+	// If MessageID is true, duplicates have the same Message-Id. If Content
+	// is true, duplicates have the same content. If both are true, duplicates
+	// must satisfy both conditions. If none is true, duplicates are found by
+	// Message-Id.
+	MessageID bool
+	Content   bool
+	// Header fields ignored when comparing contents, e.g. Received and
+	// Delivered-To, which differ between deliveries of the same message.
+	IgnoreFields []string
+}
+
+// FindDuplicates returns the groups of messages in cur which are duplicates
+// of each other. Messages without Message-Id are never duplicates by
+// Message-Id.
+//
+// The messages of a group, and the groups themselves, are sorted in delivery
+// order. Messages which cannot be read are skipped, and their errors are
+// returned as *MessageError, joined with any error encountered while scanning
+// the directory.
+func (d Dir) FindDuplicates(opts *DuplicateOptions) ([][]*Message, error) {
+	if opts == nil {
+		opts = new(DuplicateOptions)
+	}
+	byMessageID := opts.MessageID || !opts.Content
+
+	type duplicateKey struct {
+		messageID string
+		hash      [sha256.Size]byte
+	}
+	groups := make(map[duplicateKey][]*Message)
+	var errs []error
+	walkErr := d.Walk(func(msg *Message) error {
+		var k duplicateKey
+		if byMessageID {
+			h, err := msg.Header()
+			if err != nil {
+				errs = append(errs, &MessageError{msg.Key(), err})
+				return nil
+			}
+			k.messageID = strings.TrimSpace(h.Get("Message-Id"))
+			if k.messageID == "" {
+				return nil
+			}
+		}
+		if opts.Content {
+			hash, err := msg.contentHash(opts.IgnoreFields)
+			if err != nil {
+				errs = append(errs, &MessageError{msg.Key(), err})
+				return nil
+			}
+			k.hash = hash
+		}
+		groups[k] = append(groups[k], msg)
+		return nil
+	})
+
+	var duplicates [][]*Message
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		slices.SortFunc(group, func(a, b *Message) int {
+			return compareKeys(a.Key(), b.Key())
+		})
+		duplicates = append(duplicates, group)
+	}
+	slices.SortFunc(duplicates, func(a, b []*Message) int {
+		return compareKeys(a[0].Key(), b[0].Key())
+	})
+	return duplicates, errors.Join(append([]error{walkErr}, errs...)...)
+}
+
+// contentHash hashes the content of the message, without the ignored header
+// fields.
+func (msg *Message) contentHash(ignoreFields []string) ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	f, err := msg.Open()
+	if err != nil {
+		return sum, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return sum, err
+	}
+	for _, k := range ignoreFields {
+		h.Del(k)
+	}
+
+	hash := sha256.New()
+	if err := textproto.WriteHeader(hash, h); err != nil {
+		return sum, err
+	}
+	if _, err := io.Copy(hash, br); err != nil {
+		return sum, err
+	}
+	hash.Sum(sum[:0])
+	return sum, nil
+}
+
+// DedupeOptions contains options for Dir.Dedupe.
+type DedupeOptions struct {
+	DuplicateOptions
+	// If not empty, the duplicates are moved to this Maildir instead of being
+	// removed.
+	MoveTo Dir
+}
+
+// Dedupe keeps a single message of each group of duplicates found by
+// FindDuplicates, the first delivered one, and removes the others.
+//
+// The flags of the kept message are the union of the flags of the group,
+// except FlagTrashed which is only kept if all the messages have it.
+//
+// The keys of the removed or moved messages are returned, in delivery order
+// within each group. Failures on single messages do not stop the operation:
+// they are returned as *MessageError, joined with the errors of
+// FindDuplicates.
+func (d Dir) Dedupe(opts *DedupeOptions) ([]string, error) {
+	if opts == nil {
+		opts = new(DedupeOptions)
+	}
+
+	groups, err := d.FindDuplicates(&opts.DuplicateOptions)
+	errs := []error{err}
+	var removed []string
+	for _, group := range groups {
+		kept := group[0]
+		flags := kept.Flags()
+		trashed := true
+		for _, msg := range group {
+			flags = flags.Add(msg.Flags()...)
+			trashed = trashed && msg.Flags().Has(FlagTrashed)
+		}
+		if !trashed {
+			flags = flags.Remove(FlagTrashed)
+		}
+		if !flags.Equal(kept.Flags()) {
+			if err := kept.SetFlags(flags); err != nil {
+				// keep the duplicates, they might have the only copy of the
+				// flags
+				errs = append(errs, &MessageError{kept.Key(), err})
+				continue
+			}
+		}
+
+		for _, msg := range group[1:] {
+			// MoveTo might change the key
+			key := msg.Key()
+			var err error
+			if opts.MoveTo != "" {
+				_, err = msg.MoveTo(opts.MoveTo)
+			} else {
+				err = msg.Remove()
+			}
+			if err != nil {
+				errs = append(errs, &MessageError{key, err})
+				continue
+			}
+			removed = append(removed, key)
+		}
+	}
+	return removed, errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const content = "Message-Id: <a@example.org>\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"body\r\n"
+	appendMessage := func(s string, flags ...Flag) *Message {
+		msg, err := d.Append(strings.NewReader(s), flags, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	a1 := appendMessage("Received: from a\r\n" + content)
+	a2 := appendMessage("Received: from b\r\n"+content, FlagSeen)
+	a3 := appendMessage("Message-Id: <a@example.org>\r\n\r\nanother body\r\n", FlagFlagged)
+	appendMessage("Message-Id: <b@example.org>\r\n\r\nbody\r\n")
+	n1 := appendMessage("Subject: no id\r\n\r\nbody\r\n")
+	n2 := appendMessage("Subject: no id\r\n\r\nbody\r\n")
+
+	tests := []struct {
+		name string
+		opts *DuplicateOptions
+		want [][]*Message
+	}{
+		{"default", nil, [][]*Message{{a1, a2, a3}}},
+		{"content", &DuplicateOptions{Content: true}, [][]*Message{{n1, n2}}},
+		{"content ignoring fields", &DuplicateOptions{Content: true, IgnoreFields: []string{"Received"}}, [][]*Message{{a1, a2}, {n1, n2}}},
+		{"both", &DuplicateOptions{MessageID: true, Content: true, IgnoreFields: []string{"received"}}, [][]*Message{{a1, a2}}},
+	}
+	for _, tc := range tests {
+		groups, err := d.FindDuplicates(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want [][]string
+		for _, group := range groups {
+			got = append(got, messageKeys(group))
+		}
+		for _, group := range tc.want {
+			want = append(want, messageKeys(group))
+		}
+		if !slices.EqualFunc(got, want, slices.Equal) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	target := Dir(t.TempDir())
+	if err := target.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const content = "Message-Id: <a@example.org>\r\n\r\nbody\r\n"
+	var msgs []*Message
+	for _, flags := range [][]Flag{{FlagTrashed}, {FlagSeen, FlagTrashed}, {FlagReplied}} {
+		msg, err := d.Append(strings.NewReader(content), flags, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	slices.SortFunc(msgs, func(a, b *Message) int {
+		return compareKeys(a.Key(), b.Key())
+	})
+
+	// a message with the same key in the target makes MoveTo change the key
+	collision := filepath.Join(string(target), "cur", msgs[1].Key()+string(separator)+"2,")
+	if err := os.WriteFile(collision, []byte("other"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := d.Dedupe(&DedupeOptions{MoveTo: target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := messageKeys(msgs[1:]); !slices.Equal(removed, want) {
+		t.Errorf("Dedupe() = %v, want %v", removed, want)
+	}
+
+	left, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Key() != msgs[0].Key() {
+		t.Fatalf("messages left = %v, want %v", messageKeys(left), msgs[0].Key())
+	}
+	if want := NewFlags(FlagReplied, FlagSeen); !left[0].Flags().Equal(want) {
+		t.Errorf("flags = %v, want %v", left[0].Flags(), want)
+	}
+
+	moved, err := target.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(moved) != 3 {
+		t.Errorf("%v messages in target, want 3", len(moved))
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DuplicateDB records the messages delivered to each recipient, to detect
+// duplicate deliveries, like the lda-dupes database of Dovecot. Messages are
+// identified by their Message-Id.
+//
+// The database is a directory with an empty file per record, so that
+// concurrent deliveries can share it without locking. Records expire after a
+// while: the same message delivered again later is not a duplicate.
+type DuplicateDB struct {
+	dir    string
+	expiry time.Duration
+}
+
+// OpenDuplicateDB opens the duplicate database in the directory dir, and
+// creates it if needed. Records expire after expiry, or never if it is zero.
+func OpenDuplicateDB(dir string, expiry time.Duration) (*DuplicateDB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DuplicateDB{dir: dir, expiry: expiry}, nil
+}
+
+func (db *DuplicateDB) filename(messageID, recipient string) string {
+	sum := sha256.Sum256([]byte(recipient + "\x00" + messageID))
+	return filepath.Join(db.dir, hex.EncodeToString(sum[:]))
+}
+
+func (db *DuplicateDB) expired(t time.Time) bool {
+	return db.expiry > 0 && time.Since(t) > db.expiry
+}
+
+// Add records the delivery of a message to a recipient, and reports whether
+// it was already recorded, i.e. whether the message is a duplicate. The check
+// and the record are atomic.
+func (db *DuplicateDB) Add(messageID, recipient string) (duplicate bool, err error) {
+	filename := db.filename(messageID, recipient)
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if err == nil {
+			return false, f.Close()
+		} else if !errors.Is(err, fs.ErrExist) {
+			return false, err
+		}
+
+		fi, err := os.Stat(filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			// expired and removed concurrently
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if !db.expired(fi.ModTime()) {
+			return true, nil
+		}
+		if err := os.Remove(filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	// another delivery is recording the message concurrently
+	return true, nil
+}
+
+// Remove removes the record of the delivery of a message to a recipient, e.g.
+// when the delivery failed after Add.
+func (db *DuplicateDB) Remove(messageID, recipient string) error {
+	err := os.Remove(db.filename(messageID, recipient))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Expire removes the expired records. It should be run periodically.
+func (db *DuplicateDB) Expire() error {
+	if db.expiry <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !db.expired(fi.ModTime()) {
+			continue
+		}
+		err = os.Remove(filepath.Join(db.dir, entry.Name()))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
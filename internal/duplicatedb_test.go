@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDuplicateDB(t *testing.T) {
+	t.Parallel()
+	db, err := OpenDuplicateDB(filepath.Join(t.TempDir(), "dupes"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(messageID, recipient string, want bool) {
+		t.Helper()
+		dup, err := db.Add(messageID, recipient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dup != want {
+			t.Errorf("Add(%q, %q) = %v, want %v", messageID, recipient, dup, want)
+		}
+	}
+	add("a@example.org", "alice", false)
+	add("a@example.org", "alice", true)
+	add("a@example.org", "bob", false)
+
+	if err := db.Remove("a@example.org", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	add("a@example.org", "alice", false)
+
+	// expired records are not duplicates
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(db.filename("a@example.org", "bob"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	add("a@example.org", "bob", false)
+
+	if err := os.Chtimes(db.filename("a@example.org", "alice"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Expire(); err != nil {
+		t.Fatal(err)
+	}
+	if exists(db.filename("a@example.org", "alice")) {
+		t.Error("expired record not removed")
+	}
+	if !exists(db.filename("a@example.org", "bob")) {
+		t.Error("record removed before expiry")
+	}
+}
+
+func TestDelivery_duplicates(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDuplicateDB(filepath.Join(t.TempDir(), "dupes"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(content string, opts *DeliveryOptions) bool {
+		t.Helper()
+		del, err := NewDeliveryWithOptions(string(d), opts, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(del, content); err != nil {
+			t.Fatal(err)
+		}
+		if err := del.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return del.Duplicate()
+	}
+	count := func(dir string) int {
+		t.Helper()
+		entries, err := os.ReadDir(filepath.Join(string(d), dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+
+	const content = "Message-Id: <a@example.org>\r\n\r\nbody\r\n"
+	skip := &DeliveryOptions{Duplicates: db, Recipient: "alice"}
+	if deliver(content, skip) {
+		t.Error("first delivery is a duplicate")
+	}
+	if !deliver(content, skip) {
+		t.Error("second delivery is not a duplicate")
+	}
+	if n := count("new"); n != 1 {
+		t.Errorf("%v messages in new, want 1", n)
+	}
+	if n := count("tmp"); n != 0 {
+		t.Errorf("%v files left in tmp, want 0", n)
+	}
+
+	tag := &DeliveryOptions{
+		Duplicates:      db,
+		Recipient:       "alice",
+		DuplicateAction: DuplicateTag,
+		DuplicateFlags:  []Flag{FlagSeen},
+	}
+	if !deliver(content, tag) {
+		t.Error("tagged delivery is not a duplicate")
+	}
+	msgs, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || !msgs[0].Flags().Equal(NewFlags(FlagSeen)) {
+		t.Errorf("tagged duplicate not delivered to cur with flags")
+	}
+
+	// messages without Message-Id are never duplicates
+	for i := 0; i < 2; i++ {
+		if deliver("Subject: no id\r\n\r\nbody\r\n", skip) {
+			t.Error("message without Message-Id is a duplicate")
+		}
+	}
+	if n := count("new"); n != 3 {
+		t.Errorf("%v messages in new, want 3", n)
+	}
+
+	// nor are messages with a malformed header
+	const malformed = "Message-Id: <b@example.org>\r\nnot a header field\r\n\r\nbody\r\n"
+	for i := 0; i < 2; i++ {
+		if deliver(malformed, skip) {
+			t.Error("message with a malformed header is a duplicate")
+		}
+	}
+	if n := count("new"); n != 5 {
+		t.Errorf("%v messages in new, want 5", n)
+	}
+}
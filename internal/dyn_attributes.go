@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"strconv"
+)
+
+// DovecotMessageSize computes the message size in bytes and returns it with
+// the key S.
+func DovecotMessageSize() DynAttribute {
+	return &dynMsgSize{}
+}
+
+type dynMsgSize struct {
+	count int64
+}
+
+func (d *dynMsgSize) Write(p []byte) (n int, err error) {
+	d.count += int64(len(p))
+	return len(p), nil
+}
+
+func (d *dynMsgSize) Close() error {
+	return nil
+}
+
+func (d *dynMsgSize) Key() string {
+	return "S"
+}
+
+func (d *dynMsgSize) Compute() string {
+	return strconv.FormatInt(d.count, 10)
+}
+
+// DovecotMessageRFC822Size computes the message size in bytes as if all the
+// line feeds were CRLF, but counting the proper CRLF as 2 bytes, and returns
+// it with the key W.
+func DovecotMessageRFC822Size() DynAttribute {
+	return &dynMsgRFC822Size{}
+}
+
+type dynMsgRFC822Size struct {
+	count int64
+	carry bool
+}
+
+func (d *dynMsgRFC822Size) Write(p []byte) (n int, err error) {
+	// A LF is counted as a CRLF unless it follows a CR, which might have
+	// been at the end of the previous write.
+	for _, b := range p {
+		if b == '\n' && !d.carry {
+			d.count++
+		}
+		d.count++
+		d.carry = b == '\r'
+	}
+	return len(p), nil
+}
+
+func (d *dynMsgRFC822Size) Close() error {
+	return nil
+}
+
+func (d *dynMsgRFC822Size) Key() string {
+	return "W"
+}
+
+func (d *dynMsgRFC822Size) Compute() string {
+	return strconv.FormatInt(d.count, 10)
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExpungeOptions contains options for Dir.Expunge.
+type ExpungeOptions struct {
+	// If not zero, only the messages last modified before this time are
+	// removed.
+	Before time.Time
+	// If not nil, only the messages matched by this filter are removed.
+	Filter func(*Message) bool
+}
+
+// Expunge permanently removes the messages in cur flagged with FlagTrashed.
+// Messages whose flag is cleared concurrently are left in place.
+//
+// The keys of the removed messages are returned in delivery order, i.e. sorted
+// by the timestamp at the beginning of the key. Failures on single messages
+// do not stop the operation: they are returned as *MessageError, joined with
+// any error encountered while scanning the directory.
+func (d Dir) Expunge(opts *ExpungeOptions) ([]string, error) {
+	if opts == nil {
+		opts = new(ExpungeOptions)
+	}
+
+	var (
+		trashed []*Message
+		errs    []error
+	)
+	walkErr := d.Walk(func(msg *Message) error {
+		if !msg.flags.Has(FlagTrashed) {
+			return nil
+		}
+		if opts.Filter != nil && !opts.Filter(msg) {
+			return nil
+		}
+		if !opts.Before.IsZero() {
+			fi, err := os.Stat(msg.filename)
+			if err != nil {
+				errs = append(errs, &MessageError{msg.Key(), err})
+				return nil
+			}
+			if !fi.ModTime().Before(opts.Before) {
+				return nil
+			}
+		}
+		trashed = append(trashed, msg)
+		return nil
+	})
+
+	slices.SortFunc(trashed, func(a, b *Message) int {
+		return compareKeys(a.Key(), b.Key())
+	})
+
+	var removed []string
+	for _, msg := range trashed {
+		// Unlike Remove, only retry if the message is still trashed: it might
+		// have been undeleted concurrently.
+		err := os.Remove(msg.filename)
+		if errors.Is(err, fs.ErrNotExist) && msg.Refresh() == nil && msg.flags.Has(FlagTrashed) {
+			err = os.Remove(msg.filename)
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			errs = append(errs, &MessageError{msg.Key(), err})
+			continue
+		}
+		removed = append(removed, msg.Key())
+	}
+	return removed, errors.Join(append([]error{walkErr}, errs...)...)
+}
+
+// keyTime returns the delivery time encoded at the beginning of a key.
+func keyTime(key string) (time.Time, bool) {
+	secs, _, _ := strings.Cut(key, ".")
+	n, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+// compareKeys orders keys by delivery time, then lexicographically. Keys
+// without a valid delivery time are sorted last.
+func compareKeys(a, b string) int {
+	ta, oka := keyTime(a)
+	tb, okb := keyTime(b)
+	switch {
+	case oka && !okb:
+		return -1
+	case !oka && okb:
+		return 1
+	}
+	if c := ta.Compare(tb); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
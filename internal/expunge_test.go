@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir_Expunge(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// deliver messages with increasing timestamps
+	now := time.Now().Unix()
+	var keys []string
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("%d.M%dP1.host", now+int64(i), i)
+		info := "2,"
+		if i != 2 {
+			info += string(FlagTrashed)
+		}
+		filename := filepath.Join(string(d), "cur", key+string(separator)+info)
+		if err := os.WriteFile(filename, []byte("trash"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	oldFilename := filepath.Join(string(d), "cur", keys[3]+string(separator)+"2,T")
+	if err := os.Chtimes(oldFilename, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := d.Expunge(&ExpungeOptions{Before: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{keys[3]}) {
+		t.Errorf("Expunge() = %v, want %v", removed, keys[3:])
+	}
+
+	removed, err = d.Expunge(&ExpungeOptions{Filter: MatchKeys(keys[1], keys[2])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{keys[1]}) {
+		t.Errorf("Expunge() = %v, want %v", removed, keys[1:2])
+	}
+
+	removed, err = d.Expunge(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{keys[0]}) {
+		t.Errorf("Expunge() = %v, want %v", removed, keys[:1])
+	}
+
+	msgs, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Key() != keys[2] {
+		t.Errorf("Messages() = %v, want only %q", msgs, keys[2])
+	}
+}
+
+func TestDir_Expunge_concurrentUpdate(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	undeleted := filepath.Join(string(d), "cur", "1.M1P1.host"+string(separator)+"2,T")
+	seen := filepath.Join(string(d), "cur", "2.M2P1.host"+string(separator)+"2,T")
+	for _, filename := range []string{undeleted, seen} {
+		if err := os.WriteFile(filename, []byte("trash"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another client changes the flags after the messages were listed
+	removed, err := d.Expunge(&ExpungeOptions{Filter: func(msg *Message) bool {
+		var err error
+		switch msg.Filename() {
+		case undeleted:
+			err = os.Rename(undeleted, strings.TrimSuffix(undeleted, "T"))
+		case seen:
+			err = os.Rename(seen, strings.TrimSuffix(seen, "T")+"ST")
+		}
+		if err != nil {
+			t.Error(err)
+		}
+		return true
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(removed, []string{"2.M2P1.host"}) {
+		t.Errorf("Expunge() = %v, want [2.M2P1.host]", removed)
+	}
+	if _, err := os.Stat(strings.TrimSuffix(undeleted, "T")); err != nil {
+		t.Errorf("undeleted message was removed: %v", err)
+	}
+}
+
+func TestCompareKeys(t *testing.T) {
+	t.Parallel()
+	keys := []string{"invalid", "20.M1P1.host", "3.M1P1.host", "3.M0P1.host"}
+	slices.SortFunc(keys, compareKeys)
+	want := []string{"3.M0P1.host", "3.M1P1.host", "20.M1P1.host", "invalid"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("sorted keys = %v, want %v", keys, want)
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+)
+
+// Flags is a set of message flags.
+//
+// The methods of Flags never modify the receiver: they return a new set, kept
+// sorted and without duplicates.
+type Flags []Flag
+
+// NewFlags returns a set containing the given flags.
+func NewFlags(flags ...Flag) Flags {
+	fs := slices.Clone(flags)
+	slices.Sort(fs)
+	return slices.Compact(fs)
+}
+
+// Has reports whether f is in the set.
+func (fs Flags) Has(f Flag) bool {
+	return slices.Contains(fs, f)
+}
+
+// Add returns a set containing fs and the given flags.
+func (fs Flags) Add(flags ...Flag) Flags {
+	return NewFlags(append(slices.Clone(fs), flags...)...)
+}
+
+// Remove returns a set containing fs without the given flags.
+func (fs Flags) Remove(flags ...Flag) Flags {
+	return slices.DeleteFunc(NewFlags(fs...), func(f Flag) bool {
+		return slices.Contains(flags, f)
+	})
+}
+
+// Toggle returns a set containing fs, with f removed if it was present and
+// added otherwise.
+func (fs Flags) Toggle(f Flag) Flags {
+	if fs.Has(f) {
+		return fs.Remove(f)
+	}
+	return fs.Add(f)
+}
+
+// Equal reports whether fs and other contain the same flags.
+func (fs Flags) Equal(other Flags) bool {
+	return slices.Equal(NewFlags(fs...), NewFlags(other...))
+}
+
+// IMAP returns the IMAP names of the flags in the set. Flags without an IMAP
+// equivalent are skipped.
+func (fs Flags) IMAP() []string {
+	names := make([]string, 0, len(fs))
+	for _, f := range NewFlags(fs...) {
+		if name := f.IMAP(); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var imapFlags = map[Flag]string{
+	FlagSeen:    `\Seen`,
+	FlagReplied: `\Answered`,
+	FlagFlagged: `\Flagged`,
+	FlagTrashed: `\Deleted`,
+	FlagDraft:   `\Draft`,
+	FlagPassed:  "$Forwarded",
+}
+
+// IMAP returns the IMAP name of the flag, or an empty string if the flag has
+// no IMAP equivalent.
+func (f Flag) IMAP() string {
+	return imapFlags[f]
+}
+
+// ParseIMAPFlag returns the flag corresponding to an IMAP flag name. As in
+// IMAP, the name is matched case-insensitively.
+func ParseIMAPFlag(name string) (Flag, bool) {
+	for f, imapName := range imapFlags {
+		if strings.EqualFold(name, imapName) {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// ParseIMAPFlags returns the set of flags corresponding to IMAP flag names.
+// Names without a Maildir equivalent are returned separately.
+func ParseIMAPFlags(names []string) (flags Flags, unknown []string) {
+	for _, name := range names {
+		if f, ok := ParseIMAPFlag(name); ok {
+			flags = append(flags, f)
+		} else {
+			unknown = append(unknown, name)
+		}
+	}
+	return NewFlags(flags...), unknown
+}
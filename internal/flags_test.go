@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	t.Parallel()
+
+	flags := NewFlags(FlagSeen, FlagFlagged, FlagSeen)
+	if !slices.Equal(flags, Flags{FlagFlagged, FlagSeen}) {
+		t.Fatalf("NewFlags() = %v, want {FlagFlagged, FlagSeen}", flags)
+	}
+	if !flags.Has(FlagSeen) || flags.Has(FlagReplied) {
+		t.Errorf("unexpected Has() result for %v", flags)
+	}
+
+	added := flags.Add(FlagReplied, FlagSeen)
+	if !slices.Equal(added, Flags{FlagFlagged, FlagReplied, FlagSeen}) {
+		t.Errorf("Add() = %v", added)
+	}
+	if removed := added.Remove(FlagSeen, FlagDraft); !slices.Equal(removed, Flags{FlagFlagged, FlagReplied}) {
+		t.Errorf("Remove() = %v", removed)
+	}
+	if toggled := flags.Toggle(FlagSeen); !slices.Equal(toggled, Flags{FlagFlagged}) {
+		t.Errorf("Toggle() = %v", toggled)
+	}
+	if toggled := flags.Toggle(FlagDraft); !slices.Equal(toggled, Flags{FlagDraft, FlagFlagged, FlagSeen}) {
+		t.Errorf("Toggle() = %v", toggled)
+	}
+	if !slices.Equal(flags, Flags{FlagFlagged, FlagSeen}) {
+		t.Errorf("receiver was modified: %v", flags)
+	}
+	if !flags.Equal(Flags{FlagSeen, FlagFlagged}) {
+		t.Errorf("Equal() = false for %v", flags)
+	}
+}
+
+func TestFlagsIMAP(t *testing.T) {
+	t.Parallel()
+
+	all := NewFlags(FlagPassed, FlagReplied, FlagSeen, FlagTrashed, FlagDraft, FlagFlagged, 'a')
+	names := all.IMAP()
+	want := []string{`\Draft`, `\Flagged`, "$Forwarded", `\Answered`, `\Seen`, `\Deleted`}
+	if !slices.Equal(names, want) {
+		t.Fatalf("Flags.IMAP() = %v, want %v", names, want)
+	}
+
+	flags, unknown := ParseIMAPFlags(append(names, `\recent`, "$Junk"))
+	if !flags.Equal(all.Remove('a')) {
+		t.Errorf("ParseIMAPFlags() = %v, want %v", flags, all.Remove('a'))
+	}
+	if !slices.Equal(unknown, []string{`\recent`, "$Junk"}) {
+		t.Errorf("unexpected unknown flags: %v", unknown)
+	}
+
+	if f, ok := ParseIMAPFlag(`\SEEN`); !ok || f != FlagSeen {
+		t.Errorf(`ParseIMAPFlag("\\SEEN") = %q, %v`, f, ok)
+	}
+}
+
+func TestMessage_AddRemoveFlags(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, "a flagged message", nil)
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := msgs[0]
+
+	if err := msg.AddFlags(FlagSeen, FlagFlagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.RemoveFlags(FlagFlagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.AddFlags(FlagReplied); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := d.MessageByKey(msg.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := found.Flags(); !slices.Equal(flags, Flags{FlagReplied, FlagSeen}) {
+		t.Errorf("Message.Flags() = %v, want {FlagReplied, FlagSeen}", flags)
+	}
+	if found.Filename() != msg.Filename() {
+		t.Errorf("Message.Filename() = %q, want %q", msg.Filename(), found.Filename())
+	}
+}
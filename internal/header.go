@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Header is the header of a message.
+//
+// The methods of the embedded mail.Header decode common fields, e.g. Subject
+// and AddressList handle RFC 2047 encoded words. Charsets other than UTF-8,
+// US-ASCII and ISO-8859-1 require importing the
+// github.com/emersion/go-message/charset package.
+type Header struct {
+	mail.Header
+	// The offset in bytes of the message body in the message file.
+	BodyOffset int64
+}
+
+// Header reads and parses the header of a message. Only the beginning of the
+// message file, up to the end of the header, is read.
+//
+// If the message was obtained from a Cache, the header is read from the cache
+// when possible, and only contains the envelope fields.
+func (msg *Message) Header() (*Header, error) {
+	if msg.cache != nil {
+		return msg.cache.header(msg)
+	}
+	return msg.readHeader()
+}
+
+func (msg *Message) readHeader() (*Header, error) {
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readHeader(f)
+}
+
+// readHeader parses a message header from r.
+func readHeader(r io.Reader) (*Header, error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &Header{
+		Header:     mail.Header{Header: message.Header{Header: h}},
+		BodyOffset: cr.n - int64(br.Buffered()),
+	}, nil
+}
+
+// countingReader counts the bytes and lines read from the underlying reader.
+type countingReader struct {
+	r     io.Reader
+	n     int64
+	lines int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	r.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMessage_Header(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	const header = "From: =?utf-8?q?Jos=C3=A9?= <jose@example.org>\r\n" +
+		"To: someone@example.org\r\n" +
+		"Subject: =?iso-8859-1?q?Caf=E9?= menu\r\n" +
+		"Date: Tue, 10 Nov 2009 23:00:00 +0000\r\n" +
+		"\r\n"
+	const body = "Today's menu: coffee.\r\n"
+	msg, err := d.Append(strings.NewReader(header+body), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := msg.Header()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, err := h.Subject(); err != nil || subject != "Café menu" {
+		t.Errorf("Subject() = %q, %v, want %q", subject, err, "Café menu")
+	}
+	from, err := h.AddressList("From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from) != 1 || from[0].Name != "José" || from[0].Address != "jose@example.org" {
+		t.Errorf("AddressList(\"From\") = %v", from)
+	}
+	if date, err := h.Date(); err != nil || date.Year() != 2009 {
+		t.Errorf("Date() = %v, %v", date, err)
+	}
+	if h.BodyOffset != int64(len(header)) {
+		t.Errorf("BodyOffset = %d, want %d", h.BodyOffset, len(header))
+	}
+
+	f, err := os.Open(msg.Filename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(h.BodyOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != body {
+		t.Errorf("body = %q, %v, want %q", b, err, body)
+	}
+}
@@ -0,0 +1,464 @@
+package internal
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/emersion/go-message"
+)
+
+// indexFilename is the name of the full-text index file, in the Maildir
+// directory.
+const indexFilename = "maildir.index"
+
+// indexVersion is the version of the index file format. Index files with
+// another version are discarded.
+const indexVersion = 1
+
+// indexFieldGap is the gap between the positions of the words of two header
+// fields or body parts, so that phrases don't match across them.
+const indexFieldGap = 16
+
+// indexedHeaderFields are the header fields added to the full-text index.
+var indexedHeaderFields = []string{"Subject", "From", "To", "Cc", "Bcc"}
+
+// Index is a full-text index of the messages of a Dir. It indexes the words of
+// the decoded text parts and of the main header fields of the messages.
+//
+// The index is only written to disk by Save. It can always be rebuilt from the
+// messages, by Rebuild. Only a single process should use the index of a Dir.
+// An Index is safe for concurrent use.
+type Index struct {
+	dir Dir
+
+	mu       sync.Mutex
+	keys     []string // by document, empty for unused documents
+	free     []uint32 // unused documents
+	docs     map[string]uint32
+	postings map[string][]posting
+	dirty    bool
+}
+
+// posting lists the positions of a word in a document.
+type posting struct {
+	Doc       uint32
+	Positions []uint32
+}
+
+type indexFile struct {
+	Version  int
+	Keys     []string
+	Postings map[string][]posting
+}
+
+// OpenIndex opens the full-text index of the Maildir. If there is no index
+// file yet, or if it cannot be decoded, an empty index is returned.
+//
+// The index must be updated with Update to take the last changes in the
+// Maildir into account.
+func (d Dir) OpenIndex() (*Index, error) {
+	idx := &Index{dir: d}
+	idx.reset()
+
+	f, err := os.Open(filepath.Join(string(d), indexFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var file indexFile
+	if err := gob.NewDecoder(f).Decode(&file); err != nil || file.Version != indexVersion {
+		// the index can always be rebuilt from the messages
+		idx.dirty = true
+		return idx, nil
+	}
+	idx.keys = file.Keys
+	if file.Postings != nil {
+		idx.postings = file.Postings
+	}
+	for doc, key := range idx.keys {
+		if key != "" {
+			idx.docs[key] = uint32(doc)
+		} else {
+			idx.free = append(idx.free, uint32(doc))
+		}
+	}
+	return idx, nil
+}
+
+func (idx *Index) reset() {
+	idx.keys = nil
+	idx.free = nil
+	idx.docs = make(map[string]uint32)
+	idx.postings = make(map[string][]posting)
+	idx.dirty = true
+}
+
+// Update adds the new messages in cur to the index, and removes the messages
+// which are not in cur anymore.
+//
+// Messages which cannot be indexed are skipped, and their errors are returned
+// as *MessageError.
+func (idx *Index) Update() error {
+	msgs, err := walkKeys(idx.dir)
+	if err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	idx.remove(msgs)
+	var added []string
+	for key := range msgs {
+		if _, ok := idx.docs[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	idx.mu.Unlock()
+	slices.Sort(added)
+
+	// messages are read without holding the lock, so that searches aren't
+	// blocked
+	var errs []error
+	words := make(map[string]map[string][]uint32, len(added))
+	for _, key := range added {
+		w, err := indexMessage(msgs[key])
+		if err != nil {
+			errs = append(errs, &MessageError{key, err})
+			continue
+		}
+		words[key] = w
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for _, key := range added {
+		if _, ok := idx.docs[key]; ok || words[key] == nil {
+			continue // added by a concurrent Update, or failed
+		}
+		idx.add(key, words[key])
+	}
+	return errors.Join(errs...)
+}
+
+// remove removes the documents which are not in msgs. idx.mu must be held.
+func (idx *Index) remove(msgs map[string]*Message) {
+	removed := make(map[uint32]bool)
+	for key, doc := range idx.docs {
+		if _, ok := msgs[key]; !ok {
+			removed[doc] = true
+			idx.keys[doc] = ""
+			idx.free = append(idx.free, doc)
+			delete(idx.docs, key)
+		}
+	}
+	if len(removed) > 0 {
+		for word, postings := range idx.postings {
+			postings = slices.DeleteFunc(postings, func(p posting) bool {
+				return removed[p.Doc]
+			})
+			if len(postings) == 0 {
+				delete(idx.postings, word)
+			} else {
+				idx.postings[word] = postings
+			}
+		}
+		idx.dirty = true
+	}
+}
+
+// Rebuild indexes all the messages in cur from scratch.
+func (idx *Index) Rebuild() error {
+	idx.mu.Lock()
+	idx.reset()
+	idx.mu.Unlock()
+	return idx.Update()
+}
+
+// add adds a document to the index. idx.mu must be held.
+func (idx *Index) add(key string, words map[string][]uint32) {
+	doc := uint32(len(idx.keys))
+	if n := len(idx.free); n > 0 {
+		doc = idx.free[n-1]
+		idx.free = idx.free[:n-1]
+		idx.keys[doc] = key
+	} else {
+		idx.keys = append(idx.keys, key)
+	}
+	idx.docs[key] = doc
+
+	for word, positions := range words {
+		idx.postings[word] = append(idx.postings[word], posting{doc, positions})
+	}
+	idx.dirty = true
+}
+
+// Save writes the index to disk. The index file is replaced atomically.
+func (idx *Index) Save() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if !idx.dirty {
+		return nil
+	}
+
+	tmpKey, err := newKey(nil)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filepath.Join(string(idx.dir), "tmp", tmpKey)
+	err = writeFile(tmpFilename, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(&indexFile{
+			Version:  indexVersion,
+			Keys:     idx.keys,
+			Postings: idx.postings,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, filepath.Join(string(idx.dir), indexFilename)); err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	idx.dirty = false
+	return nil
+}
+
+// Search returns the keys of the indexed messages matching the query, in
+// delivery order.
+//
+// The query is a list of terms, which must all match. A term is a word, a
+// word prefix ending with "*", or a phrase between double quotes. Matching is
+// case-insensitive.
+func (idx *Index) Search(query string) ([]string, error) {
+	terms := parseIndexQuery(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var docs map[uint32]bool
+	for _, term := range terms {
+		matches := idx.match(term)
+		if docs == nil {
+			docs = matches
+		} else {
+			for doc := range docs {
+				if !matches[doc] {
+					delete(docs, doc)
+				}
+			}
+		}
+		if len(docs) == 0 {
+			return nil, nil
+		}
+	}
+
+	keys := make([]string, 0, len(docs))
+	for doc := range docs {
+		keys = append(keys, idx.keys[doc])
+	}
+	slices.SortFunc(keys, compareKeys)
+	return keys, nil
+}
+
+// indexTerm is a term of an index query.
+type indexTerm struct {
+	words  []string // consecutive words
+	prefix bool     // the last word is a prefix
+}
+
+func parseIndexQuery(query string) []indexTerm {
+	var terms []indexTerm
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 1 {
+			// between quotes
+			if words := tokenize(part); len(words) > 0 {
+				terms = append(terms, indexTerm{words: words})
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+			if words := tokenize(field); len(words) > 0 {
+				terms = append(terms, indexTerm{words: words, prefix: prefix})
+			}
+		}
+	}
+	return terms
+}
+
+// match returns the documents matching a term. idx.mu must be held.
+func (idx *Index) match(term indexTerm) map[uint32]bool {
+	// positions of the candidate phrases, by document
+	var candidates map[uint32][]uint32
+	for i, word := range term.words {
+		var postings []posting
+		if term.prefix && i == len(term.words)-1 {
+			for w, p := range idx.postings {
+				if strings.HasPrefix(w, word) {
+					postings = append(postings, p...)
+				}
+			}
+		} else {
+			postings = idx.postings[word]
+		}
+
+		next := make(map[uint32][]uint32)
+		for _, p := range postings {
+			if i == 0 {
+				next[p.Doc] = append(next[p.Doc], p.Positions...)
+				continue
+			}
+			for _, start := range candidates[p.Doc] {
+				if _, ok := slices.BinarySearch(p.Positions, start+uint32(i)); ok {
+					next[p.Doc] = append(next[p.Doc], start)
+				}
+			}
+		}
+		for doc, starts := range next {
+			slices.Sort(starts)
+			next[doc] = slices.Compact(starts)
+		}
+		candidates = next
+	}
+
+	docs := make(map[uint32]bool, len(candidates))
+	for doc, starts := range candidates {
+		if len(starts) > 0 {
+			docs[doc] = true
+		}
+	}
+	return docs
+}
+
+// tokenize splits text into lowercase words.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// indexMessage returns the positions of the words of a message.
+func indexMessage(msg *Message) (map[string][]uint32, error) {
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	e, err := message.Read(f)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+
+	words := make(map[string][]uint32)
+	var pos uint32
+	addText := func(text string) {
+		for _, word := range tokenize(text) {
+			words[word] = append(words[word], pos)
+			pos++
+		}
+		pos += indexFieldGap
+	}
+
+	for _, k := range indexedHeaderFields {
+		for hf := e.Header.FieldsByKey(k); hf.Next(); {
+			text, err := hf.Text()
+			if err != nil {
+				text = hf.Value()
+			}
+			addText(text)
+		}
+	}
+
+	err = e.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		disp, _, _ := part.Header.ContentDisposition()
+		if !strings.HasPrefix(mediaType, "text/") || strings.EqualFold(disp, "attachment") {
+			return nil
+		}
+		b, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		text := string(b)
+		if mediaType == "text/html" {
+			text = stripTags(text)
+		}
+		addText(text)
+		return nil
+	})
+	return words, err
+}
+
+// stripTags removes the HTML tags from text.
+func stripTags(text string) string {
+	var sb strings.Builder
+	inTag := false
+	for _, r := range text {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>' && inTag:
+			inTag = false
+			sb.WriteRune(' ')
+		case !inTag:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// walkKeys returns the messages in cur, by key. Malformed entries are
+// ignored.
+func walkKeys(d Dir) (map[string]*Message, error) {
+	msgs, _, err := walkKeysMalformed(d)
+	return msgs, err
+}
+
+// walkKeysMalformed is like walkKeys, but also returns the errors of the
+// malformed entries.
+func walkKeysMalformed(d Dir) (msgs map[string]*Message, malformed []error, err error) {
+	msgs = make(map[string]*Message)
+	err = d.Walk(func(msg *Message) error {
+		msgs[msg.Key()] = msg
+		return nil
+	})
+	if err == nil {
+		return msgs, nil, nil
+	}
+
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+	for _, err := range errs {
+		var (
+			mailfileErr *MailfileError
+			flagErr     *FlagError
+		)
+		if !errors.As(err, &mailfileErr) && !errors.As(err, &flagErr) {
+			return nil, nil, err
+		}
+		malformed = append(malformed, err)
+	}
+	return msgs, malformed, nil
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendMessage := func(s string) *Message {
+		msg, err := d.Append(strings.NewReader(s), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	plain := appendMessage("Subject: =?utf-8?q?R=C3=A9union?= tomorrow\r\n" +
+		"From: Alice <alice@example.org>\r\n" +
+		"\r\n" +
+		"The quarterly report is ready.\r\n")
+	html := appendMessage("Subject: Newsletter\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>The <b>quarterly</b> figures</p>\r\n")
+	attachment := appendMessage(mimeTestMessage)
+
+	idx, err := d.OpenIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Update(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []*Message
+	}{
+		{"quarterly", []*Message{plain, html}},
+		{"QUARTERLY report", []*Message{plain}},
+		{`"quarterly report"`, []*Message{plain}},
+		{`"report quarterly"`, nil},
+		{`"quarterly figures"`, []*Message{html}},
+		{"réunion", []*Message{plain}},
+		{"alice", []*Message{plain}},
+		{"quart*", []*Message{plain, html}},
+		{"news*", []*Message{html}},
+		{"holiday", []*Message{attachment}},
+		// attachments and tags are not indexed
+		{"ivborw0k", nil},
+		{"b", nil},
+		// phrases don't cross fields
+		{`"tomorrow alice"`, nil},
+		{"", nil},
+	}
+	check := func(idx *Index) {
+		t.Helper()
+		for _, tc := range tests {
+			keys, err := idx.Search(tc.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, msg := range tc.want {
+				want = append(want, msg.Key())
+			}
+			if !slices.Equal(keys, want) {
+				t.Errorf("Search(%q) = %v, want %v", tc.query, keys, want)
+			}
+		}
+	}
+	check(idx)
+
+	if err := idx.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(string(d), indexFilename)); err != nil {
+		t.Fatal(err)
+	}
+	idx, err = d.OpenIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(idx)
+
+	if err := html.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	added := appendMessage("Subject: Quarterly meeting\r\n\r\nAgenda.\r\n")
+	if err := idx.Update(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := idx.Search("quarterly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{plain.Key(), added.Key()}; !slices.Equal(keys, want) {
+		t.Errorf("Search after Update = %v, want %v", keys, want)
+	}
+	if _, ok := idx.postings["figures"]; ok {
+		t.Error("postings of removed message still in index")
+	}
+	if len(idx.keys) != 3 {
+		t.Errorf("index has %d documents, want 3 (removed document reused)", len(idx.keys))
+	}
+
+	if err := idx.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+	keys, err = idx.Search("agenda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{added.Key()}; !slices.Equal(keys, want) {
+		t.Errorf("Search after Rebuild = %v, want %v", keys, want)
+	}
+}
+
+func TestOpenIndex_corrupt(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(string(d), indexFilename), []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := d.OpenIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.keys) != 0 || !idx.dirty {
+		t.Error("corrupt index not discarded")
+	}
+}
@@ -5,13 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -100,6 +103,39 @@ func parseBasename(basename string) (key string, flags []Flag, err error) {
 	return key, flags, nil
 }
 
+// InfoSeparator separates the key of a message from its info, e.g. its flags,
+// in file names. It is ':', except on Windows where ';' is used.
+const InfoSeparator = separator
+
+// SplitBasename splits the name of a message file into the base key of the
+// message, its attributes and its info, e.g. "2,S". The info is empty for
+// files in new which have none. A *FlagError is returned if the info is not
+// in the version 2 format.
+func SplitBasename(name string) (base string, attrs Attributes, info string, err error) {
+	keyWithAttrs := name
+	if i := strings.LastIndexByte(name, byte(separator)); i >= 0 {
+		keyWithAttrs, info = name[:i], name[i+1:]
+		if !strings.HasPrefix(info, "2,") {
+			return "", nil, "", &FlagError{info, strings.HasPrefix(info, "1,")}
+		}
+	}
+	base, _, _ = strings.Cut(keyWithAttrs, ",")
+	return base, keyAttributes(keyWithAttrs), info, nil
+}
+
+// JoinBasename returns the name of a message file in cur, from the base key
+// of the message, its attributes and its info. An empty info is replaced by
+// "2,".
+func JoinBasename(base string, attrs Attributes, info string) string {
+	if ext := attrs.String(); ext != "" {
+		base += "," + ext
+	}
+	if info == "" {
+		info = "2,"
+	}
+	return base + string(separator) + info
+}
+
 func formatInfo(flags []Flag) string {
 	info := "2,"
 	sort.Sort(flagList(flags))
@@ -129,9 +165,10 @@ func (s flagList) Less(i, j int) bool { return s[i] < s[j] }
 type Message struct {
 	filename string
 	key      string
-	flags    []Flag
+	flags    Flags
 	attrs    Attributes
 	dynAttrs []DynAttribute
+	cache    *Cache
 }
 
 // Filename returns the filesystem path to the message's file.
@@ -150,8 +187,14 @@ func (msg *Message) Key() string {
 	return key
 }
 
+// Attributes returns the attributes carried by the key of the message, like
+// the S= and W= sizes.
+func (msg *Message) Attributes() Attributes {
+	return keyAttributes(msg.Key())
+}
+
 // Flags returns the message flags.
-func (msg *Message) Flags() []Flag {
+func (msg *Message) Flags() Flags {
 	return msg.flags
 }
 
@@ -159,74 +202,296 @@ func (msg *Message) Flags() []Flag {
 //
 // Any duplicate flags are dropped, and flags are sorted before being saved.
 func (msg *Message) SetFlags(flags []Flag) error {
-	newBasename := formatBasename(msg.key, flags, msg.attrs)
-	_, flags, err := parseBasename(newBasename)
+	return msg.updateFlags(func(Flags) Flags {
+		return flags
+	})
+}
+
+// AddFlags adds flags to the message, keeping the other ones.
+//
+// The file is renamed atomically, so concurrent readers see either the old or
+// the new set of flags.
+func (msg *Message) AddFlags(flags ...Flag) error {
+	return msg.updateFlags(func(cur Flags) Flags {
+		return cur.Add(flags...)
+	})
+}
+
+// RemoveFlags removes flags from the message, keeping the other ones.
+//
+// The file is renamed atomically, so concurrent readers see either the old or
+// the new set of flags.
+func (msg *Message) RemoveFlags(flags ...Flag) error {
+	return msg.updateFlags(func(cur Flags) Flags {
+		return cur.Remove(flags...)
+	})
+}
+
+// updateFlags renames the message file with the flags returned by fn, which
+// is given the current message flags.
+func (msg *Message) updateFlags(fn func(Flags) Flags) error {
+	return msg.retry(func() error {
+		flags := NewFlags(fn(msg.flags)...)
+		newBasename := formatBasename(msg.key, flags, msg.attrs, msg.dynAttrs...)
+		if _, _, err := parseBasename(newBasename); err != nil {
+			return err
+		}
+
+		newFilename := filepath.Join(filepath.Dir(msg.filename), newBasename)
+		if err := os.Rename(msg.filename, newFilename); err != nil {
+			return err
+		}
+		msg.filename = newFilename
+		msg.flags = flags
+		return nil
+	})
+}
+
+// InternalDate returns the internal date of the message, as defined by IMAP.
+// It is stored as the modification time of the message file.
+func (msg *Message) InternalDate() (time.Time, error) {
+	if msg.cache != nil {
+		return msg.cache.internalDate(msg)
+	}
+	fi, err := msg.stat()
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
+	return fi.ModTime(), nil
+}
 
-	newFilename := filepath.Join(filepath.Dir(msg.filename), newBasename)
-	if err := os.Rename(msg.filename, newFilename); err != nil {
+// SetInternalDate sets the internal date of the message.
+//
+// If the message file is hard linked, e.g. by Message.CopyTo, it is copied
+// first so that the other messages keep their internal date.
+func (msg *Message) SetInternalDate(t time.Time) error {
+	err := msg.retry(func() error {
+		fi, err := os.Stat(msg.filename)
+		if err != nil {
+			return err
+		}
+		if hardLinked(fi) {
+			if err := msg.unlink(); err != nil {
+				return err
+			}
+		}
+		return os.Chtimes(msg.filename, time.Time{}, t)
+	})
+	if err == nil && msg.cache != nil {
+		msg.cache.invalidate(msg.Key())
+	}
+	return err
+}
+
+// unlink replaces the message file with a copy, so that it isn't shared with
+// other hard links anymore.
+func (msg *Message) unlink() error {
+	key, err := renewKey(msg.key)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filepath.Join(string(msg.dir()), "tmp", key)
+	if err := copyFile(msg.filename, tmpFilename, streamFile); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFilename, msg.filename); err != nil {
+		os.Remove(tmpFilename)
 		return err
 	}
-	msg.filename = newFilename
-	msg.flags = flags
 	return nil
 }
 
-// Open reads the contents of a message.
-func (msg *Message) Open() (io.ReadCloser, error) {
-	return os.Open(msg.Filename())
+// Size returns the size of the message in bytes. It is read from the S=
+// attribute when the message has one.
+func (msg *Message) Size() (int64, error) {
+	if msg.cache != nil {
+		return msg.cache.size(msg)
+	}
+	return msg.size()
+}
+
+func (msg *Message) size() (int64, error) {
+	if v, ok := keyAttributes(msg.Key()).Get("S"); ok {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return size, nil
+		}
+	}
+	fi, err := msg.stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (msg *Message) stat() (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := msg.retry(func() (err error) {
+		fi, err = os.Stat(msg.filename)
+		return err
+	})
+	return fi, err
 }
 
 // Remove deletes a message.
 func (msg *Message) Remove() error {
-	return os.Remove(msg.Filename())
+	return msg.retry(func() error {
+		return os.Remove(msg.Filename())
+	})
 }
 
-// MoveTo moves a message from this Maildir to another one.
+// MoveTo moves a message from this Maildir to another one, and returns the
+// message in the target.
 //
-// The message flags are preserved, but its key might change.
-func (msg *Message) MoveTo(target Dir) error {
-	newFilename := filepath.Join(string(target), "cur", filepath.Base(msg.filename))
-	if err := os.Rename(msg.filename, newFilename); err != nil {
+// The message flags and internal date are preserved, but its key might
+// change: if the target already contains a message with the same key, a new
+// key is generated. Such messages are only looked for with common flags, but
+// existing files are never overwritten. When the target is
+// on another filesystem, the message is copied to the target and then
+// removed from this Maildir.
+func (msg *Message) MoveTo(target Dir) (*Message, error) {
+	err := msg.retry(func() error {
+		curDir := filepath.Join(string(target), "cur")
+		if filepath.Clean(filepath.Dir(msg.filename)) == filepath.Clean(curDir) {
+			return nil
+		}
+
+		key := msg.key
+		basename := filepath.Base(msg.filename)
+		if found, err := target.containsBaseKey(msg.key, msg.flags); err != nil {
+			return err
+		} else if found {
+			if key, err = renewKey(msg.key); err != nil {
+				return err
+			}
+			basename = formatBasename(key, msg.flags, msg.attrs, msg.dynAttrs...)
+		}
+
+		src := msg.filename
+		tmpFilename := "" // set when moving across filesystems
+		for {
+			err := renameNoReplace(src, filepath.Join(curDir, basename))
+			if errors.Is(err, syscall.EXDEV) && tmpFilename == "" {
+				tmpFilename = filepath.Join(string(target), "tmp", key)
+				if err := copyFile(msg.filename, tmpFilename, streamFile); err != nil {
+					return err
+				}
+				src = tmpFilename
+				continue
+			} else if errors.Is(err, fs.ErrExist) {
+				// created meanwhile
+				if key, err = renewKey(msg.key); err != nil {
+					return err
+				}
+				basename = formatBasename(key, msg.flags, msg.attrs, msg.dynAttrs...)
+				continue
+			} else if err != nil {
+				if tmpFilename != "" {
+					os.Remove(tmpFilename)
+				}
+				return err
+			}
+			break
+		}
+		if tmpFilename != "" {
+			if err := os.Remove(msg.filename); err != nil {
+				return err
+			}
+		}
+
+		msg.filename = filepath.Join(curDir, basename)
+		msg.key = key
+		msg.cache = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Refresh re-resolves the message file by key in the Maildir it belongs to,
+// and updates the message flags from the file name.
+//
+// This is useful when another process (e.g. another MUA) may have renamed the
+// file, for instance to change its flags.
+func (msg *Message) Refresh() error {
+	filename, err := msg.dir().filenameByKey(msg.Key())
+	if err != nil {
 		return err
 	}
-	msg.filename = newFilename
+	_, flags, err := parseBasename(filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	msg.filename = filename
+	msg.flags = flags
 	return nil
 }
 
+// dir returns the Dir the message belongs to.
+func (msg *Message) dir() Dir {
+	return Dir(filepath.Dir(filepath.Dir(msg.filename)))
+}
+
+// retry calls fn and, if it fails because the message file does not exist
+// anymore, refreshes the message and calls fn once more.
+func (msg *Message) retry(fn func() error) error {
+	err := fn()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if msg.Refresh() != nil {
+		return err
+	}
+	return fn()
+}
+
 // CopyTo copies a message from this Maildir to another one.
 //
-// The copied message is returned. Its flags will be identical but its key
-// might be different.
+// The copied message is returned. Its flags, attributes and internal date will
+// be identical but its key will be different. The content is copied with
+// CopyAuto.
 func (msg *Message) CopyTo(target Dir) (*Message, error) {
-	src, err := msg.Open()
-	if err != nil {
-		return nil, err
+	return msg.CopyToWithOptions(target, nil)
+}
+
+// CopyToWithOptions copies a message from this Maildir to another one, like
+// CopyTo. The way the content is copied depends on the strategy in opts; a
+// nil opts uses CopyAuto.
+func (msg *Message) CopyToWithOptions(target Dir, opts *CopyOptions) (*Message, error) {
+	if opts == nil {
+		opts = new(CopyOptions)
 	}
-	defer src.Close()
 
-	newMsg, dst, err := target.Create(msg.flags, msg.attrs, msg.dynAttrs...)
+	key, err := renewKey(msg.key)
 	if err != nil {
 		return nil, err
 	}
-	defer dst.Close()
+	basename := formatBasename(key, msg.flags, msg.attrs, msg.dynAttrs...)
+	newFilename := filepath.Join(string(target), "cur", basename)
+	tmpFilename := filepath.Join(string(target), "tmp", key)
 
-	if _, err = io.Copy(dst, src); err != nil {
-		return nil, err
-	}
-	if err := dst.Close(); err != nil {
+	err = msg.retry(func() error {
+		return opts.Strategy.copy(msg.filename, tmpFilename, newFilename)
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return newMsg, nil
+	return &Message{
+		filename: newFilename,
+		key:      key,
+		flags:    NewFlags(msg.flags...),
+		attrs:    msg.attrs,
+		dynAttrs: msg.dynAttrs,
+	}, nil
 }
 
 type tmpMessage struct {
-	file FileLike
-	d    string
-	msg  *Message
+	file         FileLike
+	d            string
+	msg          *Message
+	internalDate time.Time
 }
 
 func (msg tmpMessage) Write(p []byte) (n int, err error) {
@@ -237,10 +502,18 @@ func (msg tmpMessage) Close() error {
 	if err := msg.file.Close(); err != nil {
 		return err
 	}
-	info := formatInfo(msg.msg.flags)
-	basename := msg.msg.Key() + string(separator) + info
+	if !msg.internalDate.IsZero() {
+		if err := os.Chtimes(msg.file.Name(), time.Time{}, msg.internalDate); err != nil {
+			return err
+		}
+	}
+	basename := formatBasename(msg.msg.key, msg.msg.flags, msg.msg.attrs, msg.msg.dynAttrs...)
 	dest := filepath.Join(msg.d, "cur", basename)
-	return os.Rename(msg.file.Name(), dest)
+	if err := os.Rename(msg.file.Name(), dest); err != nil {
+		return err
+	}
+	msg.msg.filename = dest
+	return nil
 }
 
 // A Dir represents a single directory in a Maildir mailbox.
@@ -446,6 +719,27 @@ func (d Dir) filenameByKey(key string) (string, error) {
 	}
 }
 
+// containsBaseKey reports whether cur contains a message with the same key
+// as key, ignoring attributes and flags. To avoid reading the whole
+// directory, only the file names with the common flags, the given flags, and
+// the attributes of key or none are tried.
+func (d Dir) containsBaseKey(key string, flags []Flag) (bool, error) {
+	base, _, _ := strings.Cut(key, ",")
+	var guesses []string
+	for _, k := range slices.Compact([]string{key, base}) {
+		guesses = append(guesses, filepath.Join(string(d), "cur", k+string(separator)+formatInfo(flags)))
+		guesses = append(guesses, d.filenameGuesses(k)...)
+	}
+	for _, guess := range guesses {
+		if _, err := os.Lstat(guess); err == nil {
+			return true, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
 // MessageByKey finds a message by key.
 func (d Dir) MessageByKey(key string) (*Message, error) {
 	filename, err := d.filenameByKey(key)
@@ -489,6 +783,18 @@ func newKey(attrs Attributes, dynAttrs ...DynAttribute) (string, error) {
 	return key, nil
 }
 
+// renewKey generates a new unique key, carrying the same attributes as key.
+func renewKey(key string) (string, error) {
+	newK, err := newKey(nil)
+	if err != nil {
+		return "", err
+	}
+	if _, ext, ok := strings.Cut(key, ","); ok {
+		newK += "," + ext
+	}
+	return newK, nil
+}
+
 // Init creates the directory structure for a Maildir.
 //
 // If the main directory already exists, it tries to create the subdirectories
@@ -509,39 +815,62 @@ func (d Dir) Init() error {
 	return nil
 }
 
+// CreateOptions contains options for Dir.CreateWithOptions.
+type CreateOptions struct {
+	// If not zero, the internal date set on the message when it is committed.
+	InternalDate time.Time
+}
+
 // Create inserts a new message into the Maildir.
+//
+// The key of the message is a new base key followed by attrs and, once the
+// writer is closed, the values computed by dynAttrs.
 func (d Dir) Create(flags []Flag, attrs Attributes, dynAttrs ...DynAttribute) (*Message, io.WriteCloser, error) {
-	key, err := newKey(attrs)
+	return d.CreateWithOptions(flags, attrs, nil, dynAttrs...)
+}
+
+// CreateWithOptions inserts a new message into the Maildir, like Create.
+func (d Dir) CreateWithOptions(flags []Flag, attrs Attributes, opts *CreateOptions, dynAttrs ...DynAttribute) (*Message, io.WriteCloser, error) {
+	tmp, err := d.create(flags, attrs, opts, dynAttrs...)
 	if err != nil {
 		return nil, nil, err
 	}
+	return tmp.msg, tmp, nil
+}
+
+func (d Dir) create(flags []Flag, attrs Attributes, opts *CreateOptions, dynAttrs ...DynAttribute) (*tmpMessage, error) {
+	if opts == nil {
+		opts = new(CreateOptions)
+	}
+
+	key, err := newKey(nil)
+	if err != nil {
+		return nil, err
+	}
 
 	tmpFilename := filepath.Join(string(d), "tmp", key)
 	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	basename := formatBasename(key, flags, attrs)
 	curFilename := filepath.Join(string(d), "cur", basename)
 
-	flagsCopy := make([]Flag, len(flags))
-	copy(flagsCopy, flags)
-
 	msg := &Message{
 		filename: curFilename,
 		key:      key,
-		flags:    flagsCopy,
+		flags:    NewFlags(flags...),
 		attrs:    attrs,
 		dynAttrs: dynAttrs,
 	}
 
-	return msg,
-		&tmpMessage{
-			file: wrapFile(f, dynAttrs...),
-			d:    string(d),
-			msg:  msg,
-		}, err
+	return &tmpMessage{
+		file:         wrapFile(f, dynAttrs...),
+		d:            string(d),
+		msg:          msg,
+		internalDate: opts.InternalDate,
+	}, nil
 }
 
 // Clean removes old files from tmp and should be run periodically.
@@ -607,6 +936,19 @@ func (a Attributes) String() (stringed string) {
 	return strings.Join(kv, ",")
 }
 
+// keyAttributes parses the attributes carried by a key. Extensions which are
+// not key-value pairs are ignored.
+func keyAttributes(key string) Attributes {
+	attrs := make(Attributes)
+	_, ext, _ := strings.Cut(key, ",")
+	for _, item := range strings.Split(ext, ",") {
+		if k, v, ok := strings.Cut(item, "="); ok {
+			attrs.Set(k, v)
+		}
+	}
+	return attrs
+}
+
 func (a Attributes) copy(n int) Attributes {
 	out := make(map[string]string, len(a)+n)
 	for k, v := range a {
@@ -689,15 +1031,52 @@ func fmtAllAttributes(attrs Attributes, dynAttrs ...DynAttribute) string {
 //
 // Multiple processes can perform a delivery on the same Maildir concurrently.
 type Delivery struct {
-	file     FileLike
-	d        Dir
-	key      string
-	attrs    Attributes
-	dynAttrs []DynAttribute
+	file      FileLike
+	d         Dir
+	key       string
+	attrs     Attributes
+	dynAttrs  []DynAttribute
+	opts      DeliveryOptions
+	duplicate bool
+}
+
+// DuplicateAction is the action taken on a duplicate delivery.
+type DuplicateAction int
+
+const (
+	// DuplicateSkip discards duplicates.
+	DuplicateSkip DuplicateAction = iota
+	// DuplicateTag delivers duplicates to cur, with the flags in
+	// DeliveryOptions.DuplicateFlags.
+	DuplicateTag
+)
+
+// DeliveryOptions contains options for NewDeliveryWithOptions.
+type DeliveryOptions struct {
+	// If not nil, the database used to detect duplicate deliveries, from the
+	// Message-Id of the message. Messages without Message-Id, or whose
+	// header cannot be parsed, are never duplicates.
+	Duplicates *DuplicateDB
+	// The recipient of the message, to tell apart the deliveries of the same
+	// message to several recipients sharing a database.
+	Recipient string
+	// The action taken on duplicates, and the flags of the duplicates
+	// delivered with DuplicateTag, e.g. FlagSeen.
+	DuplicateAction DuplicateAction
+	DuplicateFlags  []Flag
 }
 
 // NewDelivery creates a new Delivery.
 func NewDelivery(d string, attrs Attributes, dynAttrs ...DynAttribute) (*Delivery, error) {
+	return NewDeliveryWithOptions(d, nil, attrs, dynAttrs...)
+}
+
+// NewDeliveryWithOptions creates a new Delivery, like NewDelivery.
+func NewDeliveryWithOptions(d string, opts *DeliveryOptions, attrs Attributes, dynAttrs ...DynAttribute) (*Delivery, error) {
+	if opts == nil {
+		opts = new(DeliveryOptions)
+	}
+
 	// NOTE: on delivery, we must first create a file in "tmp" and write to it.
 	// Because if this, we cannot add to the filename the result of the dynamic attributes,
 	// that we are here omitting. They will be used when completing the delivery, moving the
@@ -709,6 +1088,7 @@ func NewDelivery(d string, attrs Attributes, dynAttrs ...DynAttribute) (*Deliver
 	del := &Delivery{
 		attrs:    attrs,
 		dynAttrs: dynAttrs,
+		opts:     *opts,
 	}
 	filename := filepath.Join(d, "tmp", key)
 	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
@@ -727,18 +1107,68 @@ func (d *Delivery) Write(p []byte) (int, error) {
 }
 
 // Close closes the underlying file and moves it to new.
+//
+// If the delivery detects duplicates, the duplicate database is consulted
+// first. Duplicates are discarded or delivered to cur, depending on the
+// DuplicateAction, and Close returns nil: use Duplicate to tell them apart.
 func (d *Delivery) Close() error {
 	tmppath := d.file.Name()
 	err := d.file.Close()
 	if err != nil {
 		return err
 	}
+
+	var messageID string
+	if d.opts.Duplicates != nil {
+		if messageID, err = readMessageID(tmppath); err != nil {
+			return err
+		}
+	}
+	if messageID != "" {
+		d.duplicate, err = d.opts.Duplicates.Add(messageID, d.opts.Recipient)
+		if err != nil {
+			return err
+		}
+		if d.duplicate && d.opts.DuplicateAction == DuplicateSkip {
+			return os.Remove(tmppath)
+		}
+	}
+
 	key, err := newKey(d.attrs, d.dynAttrs...)
-	newfile := filepath.Join(string(d.d), "new", key)
-	if err = os.Rename(tmppath, newfile); err != nil {
-		return err
+	if err == nil {
+		newfile := filepath.Join(string(d.d), "new", key)
+		if d.duplicate {
+			newfile = filepath.Join(string(d.d), "cur", key+string(separator)+formatInfo(d.opts.DuplicateFlags))
+		}
+		err = os.Rename(tmppath, newfile)
 	}
-	return nil
+	if err != nil && messageID != "" && !d.duplicate {
+		// let the message be delivered again
+		d.opts.Duplicates.Remove(messageID, d.opts.Recipient)
+	}
+	return err
+}
+
+// Duplicate reports whether Close detected that the message was a duplicate.
+func (d *Delivery) Duplicate() bool {
+	return d.duplicate
+}
+
+// readMessageID returns the Message-Id of the message in the file filename.
+// If the header cannot be parsed, an empty Message-Id is returned, so that
+// the message is delivered as if it had none.
+func readMessageID(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h, err := readHeader(f)
+	if err != nil {
+		return "", nil
+	}
+	return strings.TrimSpace(h.Get("Message-Id")), nil
 }
 
 // Abort closes the underlying file and removes it completely.
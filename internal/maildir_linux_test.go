@@ -0,0 +1,72 @@
+//go:build linux
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// otherFilesystem returns a temporary directory on another filesystem than
+// dir, from tmpfs.
+func otherFilesystem(t *testing.T, dir string) string {
+	var st, otherSt syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat("/dev/shm", &otherSt); err != nil || otherSt.Dev == st.Dev {
+		t.Skip("no other filesystem available")
+	}
+	other, err := os.MkdirTemp("/dev/shm", "maildir-test")
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+	return other
+}
+
+func TestMove_acrossFilesystems(t *testing.T) {
+	t.Parallel()
+	d1 := Dir(filepath.Join(t.TempDir(), "d1"))
+	d2 := Dir(filepath.Join(otherFilesystem(t, filepath.Dir(string(d1))), "d2"))
+	for _, d := range []Dir{d1, d2} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	makeDelivery(t, d1, "a far away message", nil)
+	msgs, err := d1.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := msgs[0]
+	path := src.Filename()
+	key := src.Key()
+
+	moved, err := src.MoveTo(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists(path) {
+		t.Error("source file still exists")
+	}
+	if moved.Key() != key {
+		t.Errorf("moved message key = %q, want %q", moved.Key(), key)
+	}
+	if cat(t, moved.Filename()) != "a far away message" {
+		t.Error("target content doesn't match source")
+	}
+	if _, err := d2.MessageByKey(key); err != nil {
+		t.Error(err)
+	}
+	entries, err := os.ReadDir(filepath.Join(string(d2), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left in tmp", len(entries))
+	}
+}
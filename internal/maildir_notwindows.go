@@ -2,7 +2,18 @@
 
 package internal
 
+import (
+	"io/fs"
+	"syscall"
+)
+
 // The separator separates a messages unique key from its flags in the filename.
 // This should only be changed on operating systems where the colon isn't
 // allowed in filenames.
 const separator rune = ':'
+
+// hardLinked reports whether the file described by fi has other hard links.
+func hardLinked(fi fs.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
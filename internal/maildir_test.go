@@ -1,15 +1,18 @@
 package internal
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // cleanup removes a Dir's directory structure
@@ -357,6 +360,57 @@ func TestDir_Create_withDynAttrs(t *testing.T) {
 	}
 }
 
+// TestDir_Create_key checks that the key of a created message is made of a
+// fresh base key, followed by its attributes and the final values of its
+// dynamic attributes, and is the name of its file before the info.
+func TestDir_Create_key(t *testing.T) {
+	t.Parallel()
+
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	text := "this is a message"
+	msg, w, err := d.Create([]Flag{FlagFlagged}, Attributes{"V": "123", "A": "randomstring"}, &byteCountsAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, text); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	base, ext, _ := strings.Cut(msg.Key(), ",")
+	if strings.Contains(base, "=") {
+		t.Errorf("Key() = %q, base key contains attributes", msg.Key())
+	}
+	if want := fmt.Sprintf("A=randomstring,C=%v,V=123", len(text)); ext != want {
+		t.Errorf("Key() = %q, want attributes %q", msg.Key(), want)
+	}
+	if basename, want := filepath.Base(msg.Filename()), msg.Key()+string(separator)+"2,F"; basename != want {
+		t.Errorf("Filename() = %q, want basename %q", msg.Filename(), want)
+	}
+
+	key := msg.Key()
+	if err := msg.SetFlags([]Flag{FlagSeen}); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Key() != key {
+		t.Errorf("Key() = %q after SetFlags, want %q", msg.Key(), key)
+	}
+
+	found, err := d.MessageByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Key() != key {
+		t.Errorf("MessageByKey(%q).Key() = %q", key, found.Key())
+	}
+}
+
 func TestPurge(t *testing.T) {
 	t.Parallel()
 
@@ -405,7 +459,7 @@ func TestMove(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = msgs[0].MoveTo(d2)
+	moved, err := msgs[0].MoveTo(d2)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -418,6 +472,130 @@ func TestMove(t *testing.T) {
 	if cat(t, path) != msg {
 		t.Fatal("Content doesn't match")
 	}
+	if moved.Filename() != path {
+		t.Errorf("moved message filename = %q, want %q", moved.Filename(), path)
+	}
+}
+
+func TestMove_collision(t *testing.T) {
+	t.Parallel()
+	d1 := Dir(filepath.Join(t.TempDir(), "d1"))
+	d2 := Dir(filepath.Join(t.TempDir(), "d2"))
+	for _, d := range []Dir{d1, d2} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	makeDelivery(t, d1, "the moved message", Attributes{"S": "17"})
+	msgs, err := d1.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := msgs[0]
+	key := src.Key()
+	existing := filepath.Join(string(d2), "cur", filepath.Base(src.Filename()))
+	if err := os.WriteFile(existing, []byte("already there"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := src.MoveTo(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved.Key() == key {
+		t.Errorf("moved message kept key %q", key)
+	}
+	if !strings.HasSuffix(moved.Key(), ",S=17") {
+		t.Errorf("moved message key %q lost its attributes", moved.Key())
+	}
+	if cat(t, existing) != "already there" {
+		t.Error("existing message was overwritten")
+	}
+	if cat(t, moved.Filename()) != "the moved message" {
+		t.Error("moved content doesn't match")
+	}
+	if _, err := d2.MessageByKey(moved.Key()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMove_collisionWithOtherFlags(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		name   string
+		suffix func(key, base string) string
+	}{
+		{"same key", func(key, base string) string { return key + string(separator) + "2,S" }},
+		{"same base key", func(key, base string) string { return base + string(separator) + "2,F" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d1 := Dir(filepath.Join(t.TempDir(), "d1"))
+			d2 := Dir(filepath.Join(t.TempDir(), "d2"))
+			for _, d := range []Dir{d1, d2} {
+				if err := d.Init(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			makeDelivery(t, d1, "the moved message", Attributes{"S": "17"})
+			msgs, err := d1.Unseen()
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := msgs[0]
+			key := src.Key()
+			base, _, _ := strings.Cut(key, ",")
+
+			name := tc.suffix(key, base)
+			if err := os.WriteFile(filepath.Join(string(d2), "cur", name), []byte("already there"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			moved, err := src.MoveTo(d2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if movedBase, _, _ := strings.Cut(moved.Key(), ","); movedBase == base {
+				t.Errorf("moved message kept key %q", moved.Key())
+			}
+			if b, err := os.ReadFile(filepath.Join(string(d2), "cur", name)); err != nil || string(b) != "already there" {
+				t.Errorf("existing message changed: %q, %v", b, err)
+			}
+			if _, err := d2.MessageByKey(moved.Key()); err != nil {
+				t.Errorf("MessageByKey(%q) = %v", moved.Key(), err)
+			}
+		})
+	}
+}
+
+func TestRenameNoReplace(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	oldpath, newpath := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	for _, p := range []string{oldpath, newpath} {
+		if err := os.WriteFile(p, []byte(filepath.Base(p)), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := renameNoReplace(oldpath, newpath); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("renameNoReplace() on existing file = %v, want fs.ErrExist", err)
+	}
+	if cat(t, newpath) != "new" || cat(t, oldpath) != "old" {
+		t.Error("files changed by failed renameNoReplace()")
+	}
+
+	if err := os.Remove(newpath); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameNoReplace(oldpath, newpath); err != nil {
+		t.Fatal(err)
+	}
+	if exists(oldpath) || cat(t, newpath) != "old" {
+		t.Error("renameNoReplace() did not rename the file")
+	}
 }
 
 func TestCopy(t *testing.T) {
@@ -467,6 +645,58 @@ func TestCopy(t *testing.T) {
 	}
 }
 
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const msg = "a renamed message"
+	makeDelivery(t, d, msg, nil)
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate another MUA changing the flags of the message
+	stale := msgs[0]
+	renamed := filepath.Join(string(d), "cur", stale.Key()+string(separator)+"2,RS")
+	if err := os.Rename(stale.Filename(), renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stale.SetFlags([]Flag{FlagFlagged}); err != nil {
+		t.Fatal(err)
+	}
+	if flags := stale.Flags(); len(flags) != 1 || flags[0] != FlagFlagged {
+		t.Errorf("Message.Flags() = %v, want {FlagFlagged}", flags)
+	}
+	if cat(t, stale.Filename()) != msg {
+		t.Error("content doesn't match")
+	}
+
+	if err := os.Rename(stale.Filename(), renamed); err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Filename() != renamed {
+		t.Errorf("Message.Filename() = %q, want %q", stale.Filename(), renamed)
+	}
+	if flags := stale.Flags(); len(flags) != 2 || flags[0] != FlagReplied || flags[1] != FlagSeen {
+		t.Errorf("Message.Flags() = %v, want {FlagReplied, FlagSeen}", flags)
+	}
+
+	if err := stale.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	var keyErr *KeyError
+	if err := stale.Refresh(); !errors.As(err, &keyErr) {
+		t.Errorf("want *KeyError, but Refresh() = %v", err)
+	}
+}
+
 func TestIllegal(t *testing.T) {
 	t.Parallel()
 	var d1 Dir = "test_illegal"
@@ -687,3 +917,143 @@ func (c *byteCountsAttr) Compute() string {
 }
 
 var _ DynAttribute = &byteCountsAttr{}
+
+func TestInternalDate(t *testing.T) {
+	t.Parallel()
+	d1 := Dir(filepath.Join(t.TempDir(), "d1"))
+	d2 := Dir(filepath.Join(t.TempDir(), "d2"))
+	for _, d := range []Dir{d1, d2} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	msg, w, err := d1.CreateWithOptions(nil, nil, &CreateOptions{InternalDate: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "an old message"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkDate := func(msg *Message, want time.Time) {
+		t.Helper()
+		got, err := msg.InternalDate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("InternalDate() = %v, want %v", got, want)
+		}
+	}
+	checkDate(msg, date)
+
+	copied, err := msg.CopyToWithOptions(d2, &CopyOptions{Strategy: CopyStream})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDate(copied, date)
+
+	later := date.Add(time.Hour)
+	if err := copied.SetInternalDate(later); err != nil {
+		t.Fatal(err)
+	}
+	checkDate(copied, later)
+	checkDate(msg, date)
+
+	moved, err := msg.MoveTo(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDate(moved, date)
+}
+
+func TestInternalDate_hardLink(t *testing.T) {
+	t.Parallel()
+	d1 := Dir(filepath.Join(t.TempDir(), "d1"))
+	d2 := Dir(filepath.Join(t.TempDir(), "d2"))
+	for _, d := range []Dir{d1, d2} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	date := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	msg, w, err := d1.CreateWithOptions(nil, nil, &CreateOptions{InternalDate: date})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, "a linked message"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := msg.CopyTo(d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := date.Add(time.Hour)
+	if err := copied.SetInternalDate(later); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := msg.InternalDate(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(date) {
+		t.Errorf("source InternalDate() = %v, want %v", got, date)
+	}
+	if got, err := copied.InternalDate(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(later) {
+		t.Errorf("copy InternalDate() = %v, want %v", got, later)
+	}
+	if s := cat(t, copied.Filename()); s != "a linked message" {
+		t.Errorf("copy content = %q", s)
+	}
+	entries, err := os.ReadDir(filepath.Join(string(d2), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left in tmp", len(entries))
+	}
+}
+
+func TestSplitBasename(t *testing.T) {
+	sep := string(separator)
+	for _, tc := range []struct {
+		name, base, info string
+		attrs            Attributes
+		err              bool
+	}{
+		{name: "123.abc.host", base: "123.abc.host", attrs: Attributes{}},
+		{name: "123.abc.host,S=4,W=5", base: "123.abc.host", attrs: Attributes{"S": "4", "W": "5"}},
+		{name: "123.abc.host,S=4" + sep + "2,FS", base: "123.abc.host", attrs: Attributes{"S": "4"}, info: "2,FS"},
+		{name: "123.abc.host" + sep + "2,", base: "123.abc.host", attrs: Attributes{}, info: "2,"},
+		{name: "123.abc.host" + sep + "1,xyz", err: true},
+	} {
+		base, attrs, info, err := SplitBasename(tc.name)
+		if tc.err {
+			if err == nil {
+				t.Errorf("SplitBasename(%q) succeeded, want an error", tc.name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("SplitBasename(%q) = %v", tc.name, err)
+			continue
+		}
+		if base != tc.base || info != tc.info || attrs.String() != tc.attrs.String() {
+			t.Errorf("SplitBasename(%q) = %q, %v, %q, want %q, %v, %q", tc.name, base, attrs, info, tc.base, tc.attrs, tc.info)
+		}
+		name := JoinBasename(base, attrs, info)
+		if want := strings.TrimSuffix(tc.name, sep+info) + sep + cmp.Or(info, "2,"); name != want {
+			t.Errorf("JoinBasename() = %q, want %q", name, want)
+		}
+	}
+}
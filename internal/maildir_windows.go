@@ -2,7 +2,15 @@
 
 package internal
 
+import "io/fs"
+
 // The separator separates a messages unique key from its flags in the filename.
 // This should only be changed on operating systems where the colon isn't
 // allowed in filenames.
 const separator rune = ';'
+
+// hardLinked reports whether the file described by fi has other hard links.
+// The link count isn't available on Windows, so it is assumed to be true.
+func hardLinked(fi fs.FileInfo) bool {
+	return true
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// A PartError occurs when a part path doesn't match any part of a message.
+type PartError struct {
+	Path []int // the (invalid) part path
+}
+
+func (e *PartError) Error() string {
+	return "maildir: no part " + formatPartPath(e.Path) + " in message"
+}
+
+func formatPartPath(path []int) string {
+	s := make([]string, len(path))
+	for i, n := range path {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ".")
+}
+
+// Entity is a node of the MIME tree of a message.
+type Entity struct {
+	// The part path of the entity, as defined by IMAP. It is empty for the
+	// message itself.
+	Path   []int
+	Header message.Header
+	// The lowercase media type, e.g. "text/plain", and its parameters.
+	MediaType string
+	Params    map[string]string
+	// The lowercase Content-Transfer-Encoding, e.g. "base64".
+	Encoding string
+	// The lowercase Content-Disposition, e.g. "attachment", and its
+	// parameters.
+	Disposition       string
+	DispositionParams map[string]string
+	// The size in bytes and the number of lines of the encoded body.
+	Size  int64
+	Lines int64
+	// The parts of a multipart entity.
+	Children []*Entity
+	// The encapsulated message of a message/rfc822 entity.
+	Message *Entity
+}
+
+// Charset returns the lowercase charset of the entity. It defaults to
+// "us-ascii" for text entities, and is empty for other entities.
+func (e *Entity) Charset() string {
+	if charset, ok := e.Params["charset"]; ok {
+		return strings.ToLower(charset)
+	}
+	if strings.HasPrefix(e.MediaType, "text/") {
+		return "us-ascii"
+	}
+	return ""
+}
+
+// Filename returns the filename of the entity, if any.
+func (e *Entity) Filename() string {
+	if filename, ok := e.DispositionParams["filename"]; ok {
+		return filename
+	}
+	return e.Params["name"]
+}
+
+// IsAttachment reports whether the entity is an attachment, i.e. whether its
+// disposition is attachment or it is a non-text entity with a filename.
+func (e *Entity) IsAttachment() bool {
+	if e.Disposition == "attachment" {
+		return true
+	}
+	return e.Disposition != "inline" && len(e.Children) == 0 && e.Message == nil &&
+		!strings.HasPrefix(e.MediaType, "text/") && e.Filename() != ""
+}
+
+// Walk calls fn for the entity and all its descendants, depth-first.
+func (e *Entity) Walk(fn func(*Entity) error) error {
+	if err := fn(e); err != nil {
+		return err
+	}
+	if e.Message != nil {
+		if err := e.Message.Walk(fn); err != nil {
+			return err
+		}
+	}
+	for _, child := range e.Children {
+		if err := child.Walk(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Entity parses the MIME structure of a message.
+//
+// The message is streamed, so its parts are never fully loaded in memory. If
+// the message was obtained from a Cache, the structure is read from the cache
+// when possible.
+func (msg *Message) Entity() (*Entity, error) {
+	if msg.cache != nil {
+		return msg.cache.entity(msg)
+	}
+	return msg.readEntity()
+}
+
+func (msg *Message) readEntity() (*Entity, error) {
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	return readEntity(nil, h, br)
+}
+
+// readEntity parses the entity with the header h and the body r.
+func readEntity(path []int, h textproto.Header, r io.Reader) (*Entity, error) {
+	e := newEntity(path, h)
+	body := &countingReader{r: r}
+
+	switch {
+	case strings.HasPrefix(e.MediaType, "multipart/"):
+		mr := textproto.NewMultipartReader(body, e.Params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			child, err := readEntity(append(path[:len(path):len(path)], i), p.Header, p)
+			if err != nil {
+				return nil, err
+			}
+			e.Children = append(e.Children, child)
+		}
+	case e.MediaType == "message/rfc822":
+		br := bufio.NewReader(body)
+		h, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, err
+		}
+		if e.Message, err = readEntity(path, h, br); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return nil, err
+	}
+	e.Size = body.n
+	e.Lines = body.lines
+	return e, nil
+}
+
+func newEntity(path []int, h textproto.Header) *Entity {
+	mh := message.Header{Header: h}
+	mediaType, params, _ := mh.ContentType()
+	disp, dispParams, _ := mh.ContentDisposition()
+	encoding := strings.ToLower(strings.TrimSpace(mh.Get("Content-Transfer-Encoding")))
+	if encoding == "" {
+		encoding = "7bit"
+	}
+	return &Entity{
+		Path:              path,
+		Header:            mh,
+		MediaType:         strings.ToLower(mediaType),
+		Params:            params,
+		Encoding:          encoding,
+		Disposition:       strings.ToLower(disp),
+		DispositionParams: dispParams,
+	}
+}
+
+// OpenPart reads the body of the part of a message designated by an IMAP
+// part path, e.g. 2.1 for the first part of the second part. The body is
+// decoded from its Content-Transfer-Encoding, but not converted from its
+// charset.
+//
+// The message is streamed up to the part, so the part can be extracted
+// without loading the message in memory.
+func (msg *Message) OpenPart(path ...int) (io.ReadCloser, error) {
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	h, body, err := findPart(h, br, path, path, true)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rangeReader{decodeBody(h, body), f}, nil
+}
+
+// findPart returns the header and the body of the part designated by path,
+// in the entity with the header h and the body r. isMessage is true if the
+// entity is a message: then the part 1 of a non-multipart entity is its body.
+func findPart(h textproto.Header, r io.Reader, path, fullPath []int, isMessage bool) (textproto.Header, io.Reader, error) {
+	if len(path) == 0 {
+		return h, r, nil
+	}
+
+	e := newEntity(nil, h)
+	switch {
+	case strings.HasPrefix(e.MediaType, "multipart/"):
+		mr := textproto.NewMultipartReader(r, e.Params["boundary"])
+		for i := 1; i <= path[0]; i++ {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return h, nil, &PartError{fullPath}
+			} else if err != nil {
+				return h, nil, err
+			}
+			if i == path[0] {
+				return findPart(p.Header, p, path[1:], fullPath, false)
+			}
+		}
+	case isMessage && path[0] == 1:
+		return findPart(h, r, path[1:], fullPath, false)
+	case e.MediaType == "message/rfc822":
+		br := bufio.NewReader(r)
+		h, err := textproto.ReadHeader(br)
+		if err != nil {
+			return h, nil, err
+		}
+		return findPart(h, br, path, fullPath, true)
+	}
+	return h, nil, &PartError{fullPath}
+}
+
+// decodeBody decodes r according to the Content-Transfer-Encoding in h.
+func decodeBody(h textproto.Header, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// base64Cleaner drops the characters which are not part of the base64
+// alphabet, such as whitespace.
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if isBase64(b) {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+func isBase64(b byte) bool {
+	return 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+		b == '+' || b == '/' || b == '='
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const mimeTestMessage = "From: someone@example.org\r\n" +
+	"Subject: Holiday pictures\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=ISO-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=E9 au lait.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Disposition: attachment; filename=\"beach.png\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"GgoAAAAN\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: Forwarded\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"plain text\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>html</p>\r\n" +
+	"--inner--\r\n" +
+	"\r\n" +
+	"--outer--\r\n"
+
+func TestMessage_Entity(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Append(strings.NewReader(mimeTestMessage), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := msg.Entity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.MediaType != "multipart/mixed" || len(e.Children) != 3 {
+		t.Fatalf("unexpected root entity: %q with %d children", e.MediaType, len(e.Children))
+	}
+
+	text := e.Children[0]
+	if text.MediaType != "text/plain" || text.Charset() != "iso-8859-1" || text.Encoding != "quoted-printable" {
+		t.Errorf("unexpected text part: %q, %q, %q", text.MediaType, text.Charset(), text.Encoding)
+	}
+	if text.Size != int64(len("Caf=E9 au lait.")) || text.Lines != 0 {
+		t.Errorf("text part size = %d, lines = %d", text.Size, text.Lines)
+	}
+
+	attachment := e.Children[1]
+	if !attachment.IsAttachment() || attachment.Filename() != "beach.png" || attachment.Encoding != "base64" {
+		t.Errorf("unexpected attachment: %q, %q, %q", attachment.Disposition, attachment.Filename(), attachment.Encoding)
+	}
+	if text.IsAttachment() {
+		t.Error("text part is an attachment")
+	}
+
+	forwarded := e.Children[2]
+	if forwarded.MediaType != "message/rfc822" || forwarded.Message == nil {
+		t.Fatalf("unexpected forwarded part: %q", forwarded.MediaType)
+	}
+	if subject := forwarded.Message.Header.Get("Subject"); subject != "Forwarded" {
+		t.Errorf("forwarded subject = %q", subject)
+	}
+
+	var paths []string
+	e.Walk(func(e *Entity) error {
+		paths = append(paths, formatPartPath(e.Path)+" "+e.MediaType)
+		return nil
+	})
+	want := []string{
+		" multipart/mixed",
+		"1 text/plain",
+		"2 image/png",
+		"3 message/rfc822",
+		"3 multipart/alternative",
+		"3.1 text/plain",
+		"3.2 text/html",
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("Walk() visited %q, want %q", paths, want)
+	}
+}
+
+func TestMessage_OpenPart(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := d.Append(strings.NewReader(mimeTestMessage), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := d.Append(strings.NewReader("Subject: single\r\n\r\nsingle part"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		msg      *Message
+		path     []int
+		expected string
+	}{
+		"quoted-printable": {msg: msg, path: []int{1}, expected: "Caf\xe9 au lait."},
+		"base64":           {msg: msg, path: []int{2}, expected: "\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"},
+		"nested":           {msg: msg, path: []int{3, 2}, expected: "<p>html</p>"},
+		"single":           {msg: single, path: []int{1}, expected: "single part"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r, err := tc.msg.OpenPart(tc.path...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("OpenPart(%v) = %q, want %q", tc.path, b, tc.expected)
+			}
+		})
+	}
+
+	for _, path := range [][]int{{4}, {1, 1}, {3, 3}, {2}} {
+		m := msg
+		if path[0] == 2 {
+			m = single
+		}
+		_, err := m.OpenPart(path...)
+		var partErr *PartError
+		if !errors.As(err, &partErr) {
+			t.Errorf("want *PartError, but OpenPart(%v) = %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux
+
+package internal
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile memory-maps f. The file is closed once mapped.
+func mapFile(f *os.File) (MessageReader, error) {
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if fi.Size() > 0 {
+		data, err = unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			return nil, &os.PathError{Op: "mmap", Path: f.Name(), Err: err}
+		}
+	}
+	return &mappedFile{bytes.NewReader(data), data, fi}, nil
+}
+
+// mappedFile is a memory-mapped message file.
+type mappedFile struct {
+	*bytes.Reader
+	data []byte
+	fi   fs.FileInfo
+}
+
+func (m *mappedFile) Stat() (fs.FileInfo, error) {
+	return m.fi, nil
+}
+
+func (m *mappedFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	m.Reader = bytes.NewReader(nil)
+	return unix.Munmap(data)
+}
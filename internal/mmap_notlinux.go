@@ -0,0 +1,12 @@
+//go:build !linux
+
+package internal
+
+import (
+	"os"
+)
+
+// mapFile is only supported on Linux: f is returned as is.
+func mapFile(f *os.File) (MessageReader, error) {
+	return f, nil
+}
@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// MessageReader gives random access to the content of a message.
+type MessageReader interface {
+	io.ReadCloser
+	io.ReaderAt
+	io.Seeker
+	Stat() (fs.FileInfo, error)
+}
+
+var _ MessageReader = (*os.File)(nil)
+
+// Open reads the contents of a message.
+func (msg *Message) Open() (MessageReader, error) {
+	var f *os.File
+	err := msg.retry(func() (err error) {
+		f, err = os.Open(msg.Filename())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// OpenMapped reads the contents of a message, like Open. On Linux, the message
+// file is memory-mapped, which avoids a system call for each read. Elsewhere,
+// it is the same as Open.
+//
+// The message file must not be truncated while it is mapped.
+func (msg *Message) OpenMapped() (MessageReader, error) {
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	return mapFile(f.(*os.File))
+}
+
+// OpenRange reads length bytes of the contents of a message, starting at
+// offset. The range is truncated at the end of the message. Negative offsets
+// and lengths are rejected.
+func (msg *Message) OpenRange(offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("maildir: invalid range %d+%d", offset, length)
+	}
+	f, err := msg.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &rangeReader{io.NewSectionReader(f, offset, length), f}, nil
+}
+
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
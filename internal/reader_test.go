@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessage_Open(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const text = "0123456789abcdefghij"
+	msg, err := d.Append(strings.NewReader(text), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	openers := map[string]func() (MessageReader, error){
+		"Open":       msg.Open,
+		"OpenMapped": msg.OpenMapped,
+	}
+	for name, open := range openers {
+		t.Run(name, func(t *testing.T) {
+			r, err := open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+
+			fi, err := r.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != int64(len(text)) {
+				t.Errorf("Stat().Size() = %d, want %d", fi.Size(), len(text))
+			}
+
+			b := make([]byte, 4)
+			if _, err := r.ReadAt(b, 10); err != nil || string(b) != "abcd" {
+				t.Errorf("ReadAt() = %q, %v, want %q", b, err, "abcd")
+			}
+			if _, err := r.Seek(-5, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := io.ReadAll(r); err != nil || string(b) != "fghij" {
+				t.Errorf("ReadAll() = %q, %v, want %q", b, err, "fghij")
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestMessage_OpenRange(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	const text = "0123456789abcdefghij"
+	msg, err := d.Append(strings.NewReader(text), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]struct {
+		offset, length int64
+		expected       string
+	}{
+		"start":       {offset: 0, length: 5, expected: "01234"},
+		"middle":      {offset: 8, length: 4, expected: "89ab"},
+		"past-end":    {offset: 18, length: 10, expected: "ij"},
+		"after-end":   {offset: 30, length: 5, expected: ""},
+		"zero-length": {offset: 3, length: 0, expected: ""},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			r, err := msg.OpenRange(tc.offset, tc.length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.expected {
+				t.Errorf("OpenRange(%d, %d) = %q, want %q", tc.offset, tc.length, b, tc.expected)
+			}
+		})
+	}
+
+	for _, r := range [][2]int64{{-1, 5}, {0, -1}} {
+		if _, err := msg.OpenRange(r[0], r[1]); err == nil {
+			t.Errorf("OpenRange(%d, %d) succeeded, want an error", r[0], r[1])
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internal
+
+// renameNoReplace renames oldpath to newpath with linkRename. It fails with
+// fs.ErrExist instead of replacing newpath.
+func renameNoReplace(oldpath, newpath string) error {
+	return linkRename(oldpath, newpath)
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Replace atomically replaces the content of a message with the one written
+// by fn, e.g. when editing a draft.
+//
+// The new content is written to tmp and then renamed over the current file,
+// so the message is never missing. The key, flags, attributes and internal
+// date of the message are preserved, except the attributes computed by
+// dynAttrs and the S= and W= size attributes, which are recomputed from the
+// new content. Since attributes are part of the key, the value returned by
+// Key might change in that case.
+//
+// If fn returns an error, the message is left untouched.
+func (msg *Message) Replace(fn func(w io.Writer) error, dynAttrs ...DynAttribute) error {
+	dynAttrs = append(dynAttrs, sizeAttrs(msg.Key(), dynAttrs)...)
+
+	tmpKey, err := newKey(nil)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filepath.Join(string(msg.dir()), "tmp", tmpKey)
+	if err := writeFile(tmpFilename, fn, dynAttrs...); err != nil {
+		return err
+	}
+
+	computed := make(Attributes, len(dynAttrs))
+	for _, dynAttr := range dynAttrs {
+		computed.Set(dynAttr.Key(), dynAttr.Compute())
+	}
+
+	var key, newFilename string
+	err = msg.retry(func() error {
+		fi, err := os.Stat(msg.filename)
+		if err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmpFilename, time.Time{}, fi.ModTime()); err != nil {
+			return err
+		}
+
+		// Replace the content under the current name first, so that there is
+		// never more than one file for the message, then update the
+		// attributes in the name.
+		if err := os.Rename(tmpFilename, msg.filename); err != nil {
+			return err
+		}
+		key = setKeyAttributes(msg.Key(), computed)
+		newFilename = filepath.Join(filepath.Dir(msg.filename), key+string(separator)+formatInfo(msg.flags))
+		if newFilename == msg.filename {
+			return nil
+		}
+		return os.Rename(msg.filename, newFilename)
+	})
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if msg.cache != nil {
+		msg.cache.invalidate(msg.Key())
+	}
+	msg.filename = newFilename
+	msg.key = key
+	msg.attrs = nil
+	msg.dynAttrs = nil
+	return nil
+}
+
+// sizeAttrs returns the dynamic attributes recomputing the S= and W= size
+// attributes of key, unless they are already in dynAttrs.
+func sizeAttrs(key string, dynAttrs []DynAttribute) []DynAttribute {
+	attrs := keyAttributes(key)
+	for _, dynAttr := range dynAttrs {
+		delete(attrs, dynAttr.Key())
+	}
+	var l []DynAttribute
+	if _, ok := attrs.Get("S"); ok {
+		l = append(l, DovecotMessageSize())
+	}
+	if _, ok := attrs.Get("W"); ok {
+		l = append(l, DovecotMessageRFC822Size())
+	}
+	return l
+}
+
+// writeFile creates the new file filename with the content written by fn, and
+// syncs it to disk. On failure, the file is removed.
+func writeFile(filename string, fn func(w io.Writer) error, dynAttrs ...DynAttribute) (err error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	w := wrapFile(f, dynAttrs...)
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(filename)
+		}
+	}()
+
+	if err = fn(w); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// setKeyAttributes returns key with the values of the given attributes
+// replaced. Attributes not already in the key are appended, sorted by name.
+func setKeyAttributes(key string, attrs Attributes) string {
+	base, ext, _ := strings.Cut(key, ",")
+	var items []string
+	if ext != "" {
+		items = strings.Split(ext, ",")
+	}
+
+	set := make(map[string]bool, len(attrs))
+	for i, item := range items {
+		k, _, _ := strings.Cut(item, "=")
+		if v, ok := attrs.Get(k); ok {
+			items[i] = k + "=" + v
+			set[k] = true
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(attrs)) {
+		if !set[k] {
+			items = append(items, k+"="+attrs[k])
+		}
+	}
+
+	if len(items) == 0 {
+		return base
+	}
+	return base + "," + strings.Join(items, ",")
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessage_Replace(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, "first draft", Attributes{"A": "x"}, &byteCountsAttr{})
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := msgs[0]
+	if err := msg.SetFlags([]Flag{FlagDraft}); err != nil {
+		t.Fatal(err)
+	}
+	oldFilename := msg.Filename()
+	base, _, _ := strings.Cut(msg.Key(), ",")
+
+	const text = "second, longer draft"
+	err = msg.Replace(func(w io.Writer) error {
+		_, err := io.WriteString(w, text)
+		return err
+	}, &byteCountsAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := base + ",A=x,C=20"; msg.Key() != want {
+		t.Errorf("Message.Key() = %q, want %q", msg.Key(), want)
+	}
+	if exists(oldFilename) {
+		t.Error("old file still exists")
+	}
+	found, err := d.MessageByKey(msg.Key())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Filename() != msg.Filename() {
+		t.Errorf("Message.Filename() = %q, want %q", msg.Filename(), found.Filename())
+	}
+	if !slices.Equal(found.Flags(), Flags{FlagDraft}) {
+		t.Errorf("Message.Flags() = %v, want {FlagDraft}", found.Flags())
+	}
+	if cat(t, msg.Filename()) != text {
+		t.Error("content doesn't match")
+	}
+
+	errWrite := errors.New("write failed")
+	err = msg.Replace(func(w io.Writer) error {
+		io.WriteString(w, "broken")
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) {
+		t.Errorf("Replace() = %v, want %v", err, errWrite)
+	}
+	if cat(t, msg.Filename()) != text {
+		t.Error("content changed after a failed replacement")
+	}
+	entries, err := os.ReadDir(filepath.Join(string(d), "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d files left in tmp", len(entries))
+	}
+}
+
+func TestMessage_Replace_sizeAndDate(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, "first\n", Attributes{"S": "6", "W": "7"})
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := msgs[0]
+	date := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	if err := msg.SetInternalDate(date); err != nil {
+		t.Fatal(err)
+	}
+	base, _, _ := strings.Cut(msg.Key(), ",")
+
+	err = msg.Replace(func(w io.Writer) error {
+		_, err := io.WriteString(w, "second\nthird\r\n")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := base + ",S=14,W=15"; msg.Key() != want {
+		t.Errorf("Message.Key() = %q, want %q", msg.Key(), want)
+	}
+	if got, err := msg.InternalDate(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(date) {
+		t.Errorf("InternalDate() = %v, want %v", got, date)
+	}
+	entries, err := os.ReadDir(filepath.Join(string(d), "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("%d files in cur, want 1", len(entries))
+	}
+}
+
+func TestSetKeyAttributes(t *testing.T) {
+	t.Parallel()
+	testCases := map[string]struct {
+		key      string
+		attrs    Attributes
+		expected string
+	}{
+		"none":     {key: "123.abc.host", expected: "123.abc.host"},
+		"append":   {key: "123.abc.host", attrs: Attributes{"W": "2", "S": "1"}, expected: "123.abc.host,S=1,W=2"},
+		"replace":  {key: "123.abc.host,W=5,S=4", attrs: Attributes{"S": "1"}, expected: "123.abc.host,W=5,S=1"},
+		"preserve": {key: "123.abc.host,foo,S=4", attrs: Attributes{"S": "1", "A": "b"}, expected: "123.abc.host,foo,S=1,A=b"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if got := setKeyAttributes(tc.key, tc.attrs); got != tc.expected {
+				t.Errorf("setKeyAttributes() = %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
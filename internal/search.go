@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+)
+
+// SearchCriteria describes the messages matched by a search, like IMAP SEARCH
+// criteria. All the conditions must be satisfied for a message to match.
+type SearchCriteria struct {
+	// If not empty, the key of the message must be one of these.
+	Keys []string
+
+	// The message must have all the flags in Flag, and none in NotFlag.
+	// Keywords are flags too.
+	Flag    []Flag
+	NotFlag []Flag
+
+	// If not zero, the internal date of the message must not be before Since,
+	// and must be before Before.
+	Since  time.Time
+	Before time.Time
+
+	// If not zero, the size of the message must be larger than Larger, and
+	// smaller than Smaller.
+	Larger  int64
+	Smaller int64
+
+	// If not zero, the date in the Date header field of the message must not
+	// be before SentSince, and must be before SentBefore. Messages without a
+	// valid Date field don't match.
+	SentSince  time.Time
+	SentBefore time.Time
+
+	// The header of the message must contain all these fields.
+	Header []SearchCriteriaHeaderField
+
+	// The text parts of the message must contain all the strings in Body,
+	// and its header fields or text parts all the strings in Text,
+	// case-insensitively. Text parts are decoded from their transfer
+	// encoding, and from their charset when message.CharsetReader is set.
+	Body []string
+	Text []string
+
+	// The message must match none of the criteria in Not, and at least one of
+	// the two criteria of each item in Or.
+	Not []SearchCriteria
+	Or  [][2]SearchCriteria
+}
+
+// SearchCriteriaHeaderField is a header field criterion. The field matches if
+// its value contains Value, case-insensitively. An empty Value matches any
+// message with the field.
+type SearchCriteriaHeaderField struct {
+	Key, Value string
+}
+
+// Search returns the messages in cur matching the criteria.
+//
+// The criteria on keys and flags are evaluated from the file name, and the
+// ones on sizes from the S= attribute when the message has one. A message file
+// is only opened when a header criterion must be evaluated, and only read
+// past its header for Body and Text criteria. Messages which
+// cannot be evaluated are skipped, and their errors are returned as
+// *MessageError, joined with any error encountered while scanning the
+// directory.
+func (d Dir) Search(criteria *SearchCriteria) ([]*Message, error) {
+	return search(d.Walk, criteria)
+}
+
+// Search returns the messages in cur matching the criteria, like Dir.Search.
+// The messages use the cache.
+func (c *Cache) Search(criteria *SearchCriteria) ([]*Message, error) {
+	return search(c.Walk, criteria)
+}
+
+func search(walk func(func(*Message) error) error, criteria *SearchCriteria) ([]*Message, error) {
+	var (
+		msgs []*Message
+		errs []error
+	)
+	keys := make(keySets)
+	keys.add(criteria)
+	walkErr := walk(func(msg *Message) error {
+		ok, err := criteria.match(&searchMessage{Message: msg, keys: keys})
+		if err != nil {
+			errs = append(errs, &MessageError{msg.Key(), err})
+		} else if ok {
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	return msgs, errors.Join(append([]error{walkErr}, errs...)...)
+}
+
+// keySets maps the criteria with keys, including nested ones, to the set of
+// their keys.
+type keySets map[*SearchCriteria]map[string]struct{}
+
+func (sets keySets) add(c *SearchCriteria) {
+	if len(c.Keys) > 0 {
+		set := make(map[string]struct{}, len(c.Keys))
+		for _, key := range c.Keys {
+			set[key] = struct{}{}
+		}
+		sets[c] = set
+	}
+	for i := range c.Not {
+		sets.add(&c.Not[i])
+	}
+	for i := range c.Or {
+		sets.add(&c.Or[i][0])
+		sets.add(&c.Or[i][1])
+	}
+}
+
+// searchMessage lazily loads the data of a message needed by a search.
+type searchMessage struct {
+	*Message
+	keys       keySets
+	header     *Header
+	fullHeader *Header
+	entity     *Entity
+	size       int64
+	date       time.Time
+	loaded     struct{ size, date bool }
+}
+
+// getHeader returns a header containing the field k. The cached header is
+// used when the message has a cache and the field is cached.
+func (msg *searchMessage) getHeader(k string) (*Header, error) {
+	var err error
+	if msg.cache != nil && isCachedHeaderField(k) {
+		if msg.header == nil {
+			msg.header, err = msg.Header()
+		}
+		return msg.header, err
+	}
+	return msg.getFullHeader()
+}
+
+func (msg *searchMessage) getFullHeader() (*Header, error) {
+	var err error
+	if msg.fullHeader == nil {
+		msg.fullHeader, err = msg.readHeader()
+	}
+	return msg.fullHeader, err
+}
+
+func (msg *searchMessage) getEntity() (*Entity, error) {
+	var err error
+	if msg.entity == nil {
+		msg.entity, err = msg.Entity()
+	}
+	return msg.entity, err
+}
+
+func (msg *searchMessage) getSize() (int64, error) {
+	if !msg.loaded.size {
+		size, err := msg.Size()
+		if err != nil {
+			return 0, err
+		}
+		msg.size = size
+		msg.loaded.size = true
+	}
+	return msg.size, nil
+}
+
+func (msg *searchMessage) getDate() (time.Time, error) {
+	if !msg.loaded.date {
+		date, err := msg.InternalDate()
+		if err != nil {
+			return time.Time{}, err
+		}
+		msg.date = date
+		msg.loaded.date = true
+	}
+	return msg.date, nil
+}
+
+// match evaluates the criteria from the cheapest to the most expensive, and
+// stops as soon as a criterion is not satisfied.
+func (c *SearchCriteria) match(msg *searchMessage) (bool, error) {
+	if len(c.Keys) > 0 {
+		if _, ok := msg.keys[c][msg.Key()]; !ok {
+			return false, nil
+		}
+	}
+	for _, f := range c.Flag {
+		if !msg.Flags().Has(f) {
+			return false, nil
+		}
+	}
+	for _, f := range c.NotFlag {
+		if msg.Flags().Has(f) {
+			return false, nil
+		}
+	}
+
+	if c.Larger > 0 || c.Smaller > 0 {
+		size, err := msg.getSize()
+		if err != nil {
+			return false, err
+		}
+		if c.Larger > 0 && size <= c.Larger {
+			return false, nil
+		}
+		if c.Smaller > 0 && size >= c.Smaller {
+			return false, nil
+		}
+	}
+
+	if !c.Since.IsZero() || !c.Before.IsZero() {
+		date, err := msg.getDate()
+		if err != nil {
+			return false, err
+		}
+		if !c.Since.IsZero() && date.Before(c.Since) {
+			return false, nil
+		}
+		if !c.Before.IsZero() && !date.Before(c.Before) {
+			return false, nil
+		}
+	}
+
+	for i := range c.Not {
+		ok, err := c.Not[i].match(msg)
+		if err != nil || ok {
+			return false, err
+		}
+	}
+	for i := range c.Or {
+		ok, err := c.Or[i][0].match(msg)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			if ok, err = c.Or[i][1].match(msg); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+
+	for _, field := range c.Header {
+		h, err := msg.getHeader(field.Key)
+		if err != nil {
+			return false, err
+		}
+		if !matchHeaderField(h, field) {
+			return false, nil
+		}
+	}
+
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		h, err := msg.getHeader("Date")
+		if err != nil {
+			return false, err
+		}
+		date, err := h.Date()
+		if err != nil || date.IsZero() {
+			return false, nil
+		}
+		if !c.SentSince.IsZero() && date.Before(c.SentSince) {
+			return false, nil
+		}
+		if !c.SentBefore.IsZero() && !date.Before(c.SentBefore) {
+			return false, nil
+		}
+	}
+
+	for _, s := range c.Body {
+		if ok, err := msg.matchText(s, false); err != nil || !ok {
+			return false, err
+		}
+	}
+	for _, s := range c.Text {
+		if ok, err := msg.matchText(s, true); err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchText reports whether a text part of the message contains s, or one of
+// its header fields if header is set.
+func (msg *searchMessage) matchText(s string, header bool) (bool, error) {
+	s = strings.ToLower(s)
+	if header {
+		h, err := msg.getFullHeader()
+		if err != nil {
+			return false, err
+		}
+		if matchHeaderFields(h.Fields(), s) {
+			return true, nil
+		}
+	}
+	e, err := msg.getEntity()
+	if err != nil {
+		return false, err
+	}
+	return msg.matchEntityText(e, e.Path, s, header)
+}
+
+// matchEntityText is like matchText for an entity with the part path path.
+// The header of the message itself is not checked.
+func (msg *searchMessage) matchEntityText(e *Entity, path []int, s string, header bool) (bool, error) {
+	if header && len(path) > 0 && matchHeaderFields(e.Header.Fields(), s) {
+		return true, nil
+	}
+	switch {
+	case e.Message != nil:
+		// the body of an encapsulated message is its part 1
+		return msg.matchEntityText(e.Message, append(e.Path[:len(e.Path):len(e.Path)], 1), s, header)
+	case len(e.Children) > 0:
+		for _, child := range e.Children {
+			if ok, err := msg.matchEntityText(child, child.Path, s, header); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case !strings.HasPrefix(e.MediaType, "text/"):
+		return false, nil
+	}
+
+	rc, err := msg.OpenPart(path...)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if charset := e.Charset(); charset != "utf-8" && charset != "us-ascii" && message.CharsetReader != nil {
+		if r, err = message.CharsetReader(charset, r); err != nil {
+			return false, nil // unknown charset
+		}
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(strings.ToLower(string(b)), s), nil
+}
+
+func matchHeaderFields(fields message.HeaderFields, s string) bool {
+	for fields.Next() {
+		text, err := fields.Text()
+		if err != nil {
+			text = fields.Value()
+		}
+		if strings.Contains(strings.ToLower(text), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHeaderField(h *Header, field SearchCriteriaHeaderField) bool {
+	return matchHeaderFields(h.FieldsByKey(field.Key), strings.ToLower(field.Value))
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDir_Search(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
+	recent := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	messages := []struct {
+		text  string
+		flags []Flag
+		date  time.Time
+		attrs Attributes
+	}{
+		{"From: alice@example.org\r\nSubject: =?utf-8?q?R=C3=A9union?=\r\n\r\nhi", []Flag{FlagSeen}, old, nil},
+		{"From: bob@example.org\r\nSubject: Lunch\r\nX-Spam: yes\r\n\r\nhello", nil, recent, nil},
+		{"From: alice@example.org\r\nSubject: Lunch too\r\n\r\n" + strings.Repeat("x", 100), []Flag{FlagSeen, FlagFlagged}, recent, nil},
+		// the file size doesn't match S=, to check that S= is used
+		{"From: carol@example.org\r\n\r\nbig", nil, recent, Attributes{"S": "5000"}},
+	}
+	var keys []string
+	for _, m := range messages {
+		msg, err := d.Append(strings.NewReader(m.text), m.flags, m.attrs, &CreateOptions{InternalDate: m.date})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, msg.Key())
+	}
+
+	testCases := map[string]struct {
+		criteria SearchCriteria
+		expected []int
+	}{
+		"all":       {criteria: SearchCriteria{}, expected: []int{0, 1, 2, 3}},
+		"keys":      {criteria: SearchCriteria{Keys: []string{keys[1], keys[3]}}, expected: []int{1, 3}},
+		"seen":      {criteria: SearchCriteria{Flag: []Flag{FlagSeen}}, expected: []int{0, 2}},
+		"unseen":    {criteria: SearchCriteria{NotFlag: []Flag{FlagSeen}}, expected: []int{1, 3}},
+		"since":     {criteria: SearchCriteria{Since: recent}, expected: []int{1, 2, 3}},
+		"before":    {criteria: SearchCriteria{Before: recent}, expected: []int{0}},
+		"larger":    {criteria: SearchCriteria{Larger: 100}, expected: []int{2, 3}},
+		"smaller":   {criteria: SearchCriteria{Smaller: 100}, expected: []int{0, 1}},
+		"from":      {criteria: SearchCriteria{Header: []SearchCriteriaHeaderField{{"From", "ALICE"}}}, expected: []int{0, 2}},
+		"decoded":   {criteria: SearchCriteria{Header: []SearchCriteriaHeaderField{{"Subject", "réunion"}}}, expected: []int{0}},
+		"arbitrary": {criteria: SearchCriteria{Header: []SearchCriteriaHeaderField{{"X-Spam", ""}}}, expected: []int{1}},
+		"not": {criteria: SearchCriteria{
+			Not: []SearchCriteria{{Header: []SearchCriteriaHeaderField{{"Subject", "lunch"}}}},
+		}, expected: []int{0, 3}},
+		"or": {criteria: SearchCriteria{
+			Or: [][2]SearchCriteria{{{Flag: []Flag{FlagFlagged}}, {Header: []SearchCriteriaHeaderField{{"From", "bob"}}}}},
+		}, expected: []int{1, 2}},
+		"nested keys": {criteria: SearchCriteria{
+			Not: []SearchCriteria{{Keys: []string{keys[0]}}},
+			Or:  [][2]SearchCriteria{{{Keys: []string{keys[1]}}, {Keys: []string{keys[0], keys[2]}}}},
+		}, expected: []int{1, 2}},
+		"and": {criteria: SearchCriteria{
+			Flag:   []Flag{FlagSeen},
+			Header: []SearchCriteriaHeaderField{{"Subject", "lunch"}},
+		}, expected: []int{2}},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			msgs, err := d.Search(&tc.criteria)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want []string
+			for _, msg := range msgs {
+				got = append(got, msg.Key())
+			}
+			for _, i := range tc.expected {
+				want = append(want, keys[i])
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Search() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestDir_Search_opensOnlyNeededFiles(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	seen, err := d.Append(strings.NewReader("Subject: seen\r\n\r\n"), []Flag{FlagSeen}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unseen, err := d.Append(strings.NewReader("Subject: unseen\r\n\r\n"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an unreadable file fails the search if it is opened
+	if err := os.Chmod(unseen.Filename(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if f, err := os.Open(unseen.Filename()); err == nil {
+		f.Close()
+		t.Skip("cannot make a file unreadable")
+	}
+
+	msgs, err := d.Search(&SearchCriteria{
+		Flag:   []Flag{FlagSeen},
+		Header: []SearchCriteriaHeaderField{{"Subject", "seen"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Key() != seen.Key() {
+		t.Errorf("Search() = %v, want only %q", msgs, seen.Key())
+	}
+}
+
+func TestDir_Search_content(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, text := range []string{
+		mimeTestMessage,
+		"Date: Wed, 1 Jan 2020 10:00:00 +0000\r\nSubject: Plain text\r\n\r\nSee you at the beach.\r\n",
+		"Date: not a date\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\naHR0cCBsYWl0\r\n",
+	} {
+		msg, err := d.Append(strings.NewReader(text), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, msg.Key())
+	}
+
+	day := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	testCases := map[string]struct {
+		criteria SearchCriteria
+		expected []int
+	}{
+		"sent-since":      {criteria: SearchCriteria{SentSince: day}, expected: []int{1}},
+		"sent-before":     {criteria: SearchCriteria{SentBefore: day}, expected: nil},
+		"body":            {criteria: SearchCriteria{Body: []string{"BEACH"}}, expected: []int{1}},
+		"body-nested":     {criteria: SearchCriteria{Body: []string{"plain text"}}, expected: []int{0}},
+		"body-html":       {criteria: SearchCriteria{Body: []string{"<p>html"}}, expected: []int{0}},
+		"body-decoded":    {criteria: SearchCriteria{Body: []string{"http lait"}}, expected: []int{2}},
+		"body-attachment": {criteria: SearchCriteria{Body: []string{"iVBORw0K"}}, expected: nil},
+		"body-header":     {criteria: SearchCriteria{Body: []string{"holiday"}}, expected: nil},
+		"text-header":     {criteria: SearchCriteria{Text: []string{"holiday"}}, expected: []int{0}},
+		"text-part":       {criteria: SearchCriteria{Text: []string{"forwarded"}}, expected: []int{0}},
+		"text-body":       {criteria: SearchCriteria{Text: []string{"beach"}}, expected: []int{0, 1}},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			msgs, err := d.Search(&tc.criteria)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want []string
+			for _, msg := range msgs {
+				got = append(got, msg.Key())
+			}
+			for _, i := range tc.expected {
+				want = append(want, keys[i])
+			}
+			slices.Sort(got)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("Search() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Snapshot is the state of the messages of a Maildir at some point in time,
+// by key. Since attributes are part of keys, a message whose attributes
+// change is seen as removed and added again.
+//
+// A Snapshot can be stored with MarshalBinary, e.g. to find out what changed
+// since the last session.
+type Snapshot map[string]SnapshotEntry
+
+// SnapshotEntry is the state of a message in a Snapshot.
+type SnapshotEntry struct {
+	Flags Flags
+	// New is true if the message was still in new.
+	New bool
+}
+
+// Snapshot returns the state of the messages in new and cur. Each directory is
+// read once, and message files are not opened.
+//
+// Malformed entries are skipped, and their errors are returned, like Walk.
+func (d Dir) Snapshot() (Snapshot, error) {
+	s := make(Snapshot)
+
+	f, err := os.Open(filepath.Join(string(d), "new"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	for {
+		names, err := f.Readdirnames(readdirChunk)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for _, n := range names {
+			if n[0] == '.' {
+				continue
+			}
+			// discard the info field, like Unseen
+			key, _, _ := strings.Cut(n, string(separator))
+			s[key] = SnapshotEntry{New: true}
+		}
+	}
+
+	err = d.Walk(func(msg *Message) error {
+		s[msg.Key()] = SnapshotEntry{Flags: msg.flags}
+		return nil
+	})
+	var (
+		mailfileErr *MailfileError
+		flagErr     *FlagError
+	)
+	if err != nil && !errors.As(err, &mailfileErr) && !errors.As(err, &flagErr) {
+		return nil, err
+	}
+	return s, err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (s Snapshot) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[string]SnapshotEntry(s)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (s *Snapshot) UnmarshalBinary(data []byte) error {
+	var m map[string]SnapshotEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m); err != nil {
+		return err
+	}
+	if m == nil {
+		m = make(map[string]SnapshotEntry)
+	}
+	*s = m
+	return nil
+}
+
+// SnapshotDiff describes the changes between two snapshots. Keys are sorted
+// in delivery order.
+type SnapshotDiff struct {
+	Added, Removed []string
+	// The messages whose flags changed. A message moved from new to cur
+	// without flags is not included.
+	FlagsChanged []string
+}
+
+// Diff returns the changes from the snapshot from to the snapshot to.
+func Diff(from, to Snapshot) *SnapshotDiff {
+	diff := new(SnapshotDiff)
+	for key, entry := range to {
+		oldEntry, ok := from[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, key)
+		case !oldEntry.Flags.Equal(entry.Flags):
+			diff.FlagsChanged = append(diff.FlagsChanged, key)
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	for _, keys := range [][]string{diff.Added, diff.Removed, diff.FlagsChanged} {
+		slices.SortFunc(keys, compareKeys)
+	}
+	return diff
+}
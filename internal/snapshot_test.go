@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendMessage := func(flags ...Flag) *Message {
+		msg, err := d.Append(strings.NewReader("Subject: test\r\n\r\n"), flags, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	kept := appendMessage()
+	flagged := appendMessage(FlagSeen)
+	removed := appendMessage()
+	if err := Deliver(string(d), strings.NewReader("Subject: new\r\n\r\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 4 {
+		t.Fatalf("snapshot has %v messages, want 4", len(old))
+	}
+	if entry := old[flagged.Key()]; entry.New || !entry.Flags.Equal(NewFlags(FlagSeen)) {
+		t.Errorf("entry = %+v, want seen message in cur", entry)
+	}
+
+	data, err := old.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Snapshot
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(old) || !decoded[flagged.Key()].Flags.Equal(old[flagged.Key()].Flags) {
+		t.Errorf("decoded snapshot = %v, want %v", decoded, old)
+	}
+
+	unseen, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flagged.AddFlags(FlagFlagged); err != nil {
+		t.Fatal(err)
+	}
+	if err := removed.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	added := appendMessage()
+
+	cur, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := Diff(decoded, cur)
+	if !slices.Equal(diff.Added, []string{added.Key()}) {
+		t.Errorf("Added = %v, want %v", diff.Added, added.Key())
+	}
+	if !slices.Equal(diff.Removed, []string{removed.Key()}) {
+		t.Errorf("Removed = %v, want %v", diff.Removed, removed.Key())
+	}
+	if !slices.Equal(diff.FlagsChanged, []string{flagged.Key()}) {
+		t.Errorf("FlagsChanged = %v, want %v", diff.FlagsChanged, flagged.Key())
+	}
+	if entry := cur[unseen[0].Key()]; entry.New {
+		t.Errorf("message moved to cur still new")
+	}
+	if _, ok := cur[kept.Key()]; !ok {
+		t.Errorf("kept message missing from snapshot")
+	}
+
+	// malformed entries are skipped
+	if err := os.WriteFile(filepath.Join(string(d), "cur", "malformed"), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.Snapshot()
+	if err == nil {
+		t.Error("Snapshot() with malformed entry: no error")
+	}
+	if len(s) != len(cur) {
+		t.Errorf("snapshot has %v messages, want %v", len(s), len(cur))
+	}
+}
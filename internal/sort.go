@@ -0,0 +1,290 @@
+package internal
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SortKey is a sort key, as defined by RFC 5256 SORT.
+type SortKey int
+
+const (
+	// SortArrival sorts by delivery time, read from the key.
+	SortArrival SortKey = iota
+	// SortCc sorts by the mailbox of the first Cc address.
+	SortCc
+	// SortDate sorts by the Date header field, or by the internal date when
+	// the field is missing or invalid.
+	SortDate
+	// SortFrom sorts by the mailbox of the first From address.
+	SortFrom
+	// SortSize sorts by size.
+	SortSize
+	// SortSubject sorts by base subject, see BaseSubject.
+	SortSubject
+	// SortTo sorts by the mailbox of the first To address.
+	SortTo
+)
+
+// SortCriterion is a sort key, optionally in reverse order.
+type SortCriterion struct {
+	Key     SortKey
+	Reverse bool
+}
+
+// Sort returns the messages in cur sorted according to the criteria, like
+// SortMessages. Errors encountered while scanning the directory are joined
+// with the sort errors.
+func (d Dir) Sort(criteria ...SortCriterion) ([]*Message, error) {
+	msgs, walkErr := d.Messages()
+	err := SortMessages(msgs, criteria...)
+	return msgs, errors.Join(walkErr, err)
+}
+
+// Sort returns the messages in cur sorted according to the criteria, like
+// Dir.Sort. The messages use the cache.
+func (c *Cache) Sort(criteria ...SortCriterion) ([]*Message, error) {
+	msgs, walkErr := c.Messages()
+	err := SortMessages(msgs, criteria...)
+	return msgs, errors.Join(walkErr, err)
+}
+
+// SortMessages sorts messages according to the criteria, with the semantics
+// of RFC 5256 SORT. Strings are compared case-insensitively. Messages which
+// compare equal on all the criteria are sorted by arrival.
+//
+// Only the data needed by the criteria is read: the key for SortArrival, the
+// size for SortSize, and the header for the other keys. Messages obtained
+// from a Cache use it. Messages whose data cannot be read are sorted as if
+// their data was empty, and their errors are returned as *MessageError.
+func SortMessages(msgs []*Message, criteria ...SortCriterion) error {
+	entries := make([]sortEntry, len(msgs))
+	var errs []error
+	for i, msg := range msgs {
+		entries[i] = sortEntry{msg: msg}
+		if err := entries[i].load(criteria); err != nil {
+			errs = append(errs, &MessageError{msg.Key(), err})
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b sortEntry) int {
+		for i, c := range criteria {
+			var r int
+			switch c.Key {
+			case SortArrival:
+				r = compareKeys(a.msg.Key(), b.msg.Key())
+			case SortDate:
+				r = a.values[i].t.Compare(b.values[i].t)
+			case SortSize:
+				r = cmp.Compare(a.values[i].n, b.values[i].n)
+			default:
+				r = strings.Compare(a.values[i].s, b.values[i].s)
+			}
+			if c.Reverse {
+				r = -r
+			}
+			if r != 0 {
+				return r
+			}
+		}
+		return compareKeys(a.msg.Key(), b.msg.Key())
+	})
+
+	for i, e := range entries {
+		msgs[i] = e.msg
+	}
+	return errors.Join(errs...)
+}
+
+// sortAddressFields are the header fields of the address sort keys.
+var sortAddressFields = map[SortKey]string{
+	SortCc:   "Cc",
+	SortFrom: "From",
+	SortTo:   "To",
+}
+
+type sortEntry struct {
+	msg    *Message
+	values []sortValue // by criterion
+}
+
+type sortValue struct {
+	s string
+	n int64
+	t time.Time
+}
+
+// load reads the values of the criteria for the message.
+func (e *sortEntry) load(criteria []SortCriterion) error {
+	e.values = make([]sortValue, len(criteria))
+
+	var h *Header
+	getHeader := func() (*Header, error) {
+		var err error
+		if h == nil {
+			h, err = e.msg.Header()
+		}
+		return h, err
+	}
+
+	for i, c := range criteria {
+		v := &e.values[i]
+		switch c.Key {
+		case SortArrival:
+			// compared by key
+		case SortSize:
+			size, err := e.msg.Size()
+			if err != nil {
+				return err
+			}
+			v.n = size
+		case SortDate:
+			h, err := getHeader()
+			if err != nil {
+				return err
+			}
+			if t, err := h.Date(); err == nil && !t.IsZero() {
+				v.t = t
+			} else if v.t, err = e.msg.InternalDate(); err != nil {
+				return err
+			}
+		case SortSubject:
+			h, err := getHeader()
+			if err != nil {
+				return err
+			}
+			subject, err := h.Subject()
+			if err != nil {
+				subject = h.Get("Subject")
+			}
+			v.s, _ = BaseSubject(subject)
+		case SortCc, SortFrom, SortTo:
+			h, err := getHeader()
+			if err != nil {
+				return err
+			}
+			v.s = firstMailbox(h, sortAddressFields[c.Key])
+		}
+	}
+	return nil
+}
+
+// firstMailbox returns the lowercase local part of the first address of the
+// header field k, or an empty string.
+func firstMailbox(h *Header, k string) string {
+	addrs, err := h.AddressList(k)
+	if err != nil || len(addrs) == 0 {
+		return ""
+	}
+	addr := addrs[0].Address
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		addr = addr[:i]
+	}
+	return asciiLower(addr)
+}
+
+// asciiLower maps the ASCII letters of s to lower case, as the i;ascii-casemap
+// collation.
+func asciiLower(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// BaseSubject returns the base subject of a decoded subject, as defined by
+// RFC 5256: the subject without the reply and forward markers and the
+// leading "[...]" blobs, in lower case. isReply reports whether markers were
+// removed.
+func BaseSubject(subject string) (base string, isReply bool) {
+	s := strings.Join(strings.Fields(subject), " ")
+	for {
+		// remove the trailing "(fwd)"
+		for {
+			s = strings.TrimRight(s, " ")
+			if !hasSuffixFold(s, "(fwd)") {
+				break
+			}
+			s = s[:len(s)-len("(fwd)")]
+			isReply = true
+		}
+
+		// remove the leading "re:", "fwd:" and blobs
+		for {
+			s = strings.TrimLeft(s, " ")
+			if rest, ok := trimSubjectRefwd(s); ok {
+				s = rest
+				isReply = true
+				continue
+			}
+			if rest, ok := trimSubjectBlob(s); ok && rest != "" {
+				s = rest
+				continue
+			}
+			break
+		}
+
+		// unwrap "[fwd: ...]"
+		if hasPrefixFold(s, "[fwd:") && strings.HasSuffix(s, "]") && len(s) > len("[fwd:") {
+			s = s[len("[fwd:") : len(s)-1]
+			isReply = true
+			continue
+		}
+		return asciiLower(s), isReply
+	}
+}
+
+// trimSubjectRefwd removes a leading subj-leader, e.g. "[list] Re:".
+func trimSubjectRefwd(s string) (string, bool) {
+	rest := s
+	for {
+		r, ok := trimSubjectBlob(rest)
+		if !ok {
+			break
+		}
+		rest = r
+	}
+	switch {
+	case hasPrefixFold(rest, "re"):
+		rest = rest[len("re"):]
+	case hasPrefixFold(rest, "fwd"):
+		rest = rest[len("fwd"):]
+	case hasPrefixFold(rest, "fw"):
+		rest = rest[len("fw"):]
+	default:
+		return s, false
+	}
+	rest = strings.TrimLeft(rest, " ")
+	if r, ok := trimSubjectBlob(rest); ok {
+		rest = r
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return s, false
+	}
+	return rest[1:], true
+}
+
+// trimSubjectBlob removes a leading subj-blob, e.g. "[list] ".
+func trimSubjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	i := strings.IndexAny(s[1:], "[]")
+	if i < 0 || s[1+i] != ']' {
+		return s, false
+	}
+	return strings.TrimLeft(s[i+2:], " "), true
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBaseSubject(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		subject string
+		base    string
+		isReply bool
+	}{
+		{"Hello", "hello", false},
+		{"  Hello   world ", "hello world", false},
+		{"Re: Hello", "hello", true},
+		{"RE: re: Fwd: Hello", "hello", true},
+		{"Re[2]: Hello", "hello", true},
+		{"[list] Re: Hello", "hello", true},
+		{"Re: [list] Hello", "hello", true},
+		{"Hello (fwd)", "hello", true},
+		{"[Fwd: Hello]", "hello", true},
+		{"[Fwd: Re: Hello (fwd)]", "hello", true},
+		{"[list] Hello", "hello", false},
+		{"[list]", "[list]", false},
+		{"Reply: Hello", "reply: hello", false},
+		{"", "", false},
+	}
+	for _, tc := range tests {
+		base, isReply := BaseSubject(tc.subject)
+		if base != tc.base || isReply != tc.isReply {
+			t.Errorf("BaseSubject(%q) = %q, %v, want %q, %v", tc.subject, base, isReply, tc.base, tc.isReply)
+		}
+	}
+}
+
+func TestSortMessages(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendMessage := func(s string) *Message {
+		msg, err := d.Append(strings.NewReader(s), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	a := appendMessage("Date: Tue, 10 Nov 2009 23:00:00 +0000\r\n" +
+		"From: Zoe <zoe@example.org>\r\n" +
+		"To: bob@example.org\r\n" +
+		"Subject: Re: Budget\r\n" +
+		"\r\n" +
+		"short\r\n")
+	b := appendMessage("Date: Tue, 10 Nov 2009 22:00:00 -0200\r\n" +
+		"From: alice@example.org\r\n" +
+		"To: Carol <carol@example.org>\r\n" +
+		"Subject: Agenda\r\n" +
+		"\r\n" +
+		"a longer body\r\n")
+	c := appendMessage("From: Bob@example.org\r\n" +
+		"Subject: [Fwd: budget]\r\n" +
+		"\r\n" +
+		"the body\r\n")
+
+	msgs, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	arrival := slices.Clone(msgs)
+	slices.SortFunc(arrival, func(a, b *Message) int {
+		return compareKeys(a.Key(), b.Key())
+	})
+
+	tests := []struct {
+		name     string
+		criteria []SortCriterion
+		want     []*Message
+	}{
+		{"arrival", []SortCriterion{{Key: SortArrival}}, arrival},
+		{"reverse arrival", []SortCriterion{{Key: SortArrival, Reverse: true}}, []*Message{arrival[2], arrival[1], arrival[0]}},
+		{"from", []SortCriterion{{Key: SortFrom}}, []*Message{b, c, a}},
+		{"to", []SortCriterion{{Key: SortTo}}, []*Message{c, a, b}},
+		{"size", []SortCriterion{{Key: SortSize}}, []*Message{c, a, b}},
+		{"reverse size", []SortCriterion{{Key: SortSize, Reverse: true}}, []*Message{b, a, c}},
+		// c has no Date, so its internal date, i.e. now, is used
+		{"date", []SortCriterion{{Key: SortDate}}, []*Message{a, b, c}},
+		{"subject then reverse size", []SortCriterion{{Key: SortSubject}, {Key: SortSize, Reverse: true}}, []*Message{b, a, c}},
+	}
+	for _, tc := range tests {
+		sorted := slices.Clone(msgs)
+		if err := SortMessages(sorted, tc.criteria...); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := messageKeys(sorted), messageKeys(tc.want); !slices.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+
+	cache, err := d.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := cache.Sort(SortCriterion{Key: SortFrom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := messageKeys(sorted), messageKeys([]*Message{b, c, a}); !slices.Equal(got, want) {
+		t.Errorf("Cache.Sort: got %v, want %v", got, want)
+	}
+}
+
+func messageKeys(msgs []*Message) []string {
+	keys := make([]string, len(msgs))
+	for i, msg := range msgs {
+		keys[i] = msg.Key()
+	}
+	return keys
+}
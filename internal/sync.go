@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// syncStateHeader is the first line of a synchronization state file.
+const syncStateHeader = "maildir-sync 1"
+
+// ConflictPolicy is the way Sync resolves the flags of a message changed on
+// both sides.
+type ConflictPolicy int
+
+const (
+	// Keep the flags added on either side, and remove the flags removed on
+	// either side.
+	ConflictMerge ConflictPolicy = iota
+	// Keep the flags of the local message.
+	ConflictPreferLocal
+	// Keep the flags of the remote message.
+	ConflictPreferRemote
+)
+
+// SyncOptions contains options for Sync.
+type SyncOptions struct {
+	// Conflict is the way flag conflicts are resolved.
+	Conflict ConflictPolicy
+	// If true, the messages in new are moved to cur with Dir.Unseen first.
+	// Otherwise, only the messages in cur are synchronized.
+	ProcessNew bool
+	// The way new messages are copied.
+	Copy CopyOptions
+	// If true, deletions are propagated even if all the messages of a side
+	// are gone. Otherwise, Sync fails in that case, since it is more likely
+	// caused by a missing or replaced directory than by deleting all the
+	// messages.
+	AllowEmpty bool
+}
+
+// SyncConflict describes the flags of a message changed on both sides.
+type SyncConflict struct {
+	Key           string
+	Local, Remote Flags // the conflicting flags
+	Resolved      Flags // the flags set on both sides
+}
+
+// SyncResult describes the changes made by Sync. Messages are identified by
+// key.
+type SyncResult struct {
+	// The new messages copied from the remote Maildir to the local one, and
+	// conversely.
+	Pulled, Pushed []string
+	// The messages removed from the local Maildir because they were deleted
+	// from the remote one, and conversely.
+	RemovedLocal, RemovedRemote []string
+	// The messages whose flags were updated on at least one side.
+	Updated   []string
+	Conflicts []SyncConflict
+}
+
+// Sync synchronizes two Maildirs, in both directions: new messages are copied,
+// flag changes are applied, and deletions are propagated. Messages are
+// matched by key: copies keep the key of the original message.
+//
+// The state of the last synchronization is stored in the file statePath,
+// which must be dedicated to this pair of Maildirs. Operations are journaled
+// to statePath with the ".journal" suffix as they are applied, so an
+// interrupted synchronization resumes where it stopped. Only a single
+// synchronization should run at a time for a state file.
+//
+// Failures on single messages do not stop the synchronization: they are
+// returned as *MessageError, and the messages are synchronized again next
+// time. If a side has malformed files, deletions are not propagated, since
+// the missing messages might only be unreadable, and the malformed files are
+// returned as errors too.
+func Sync(local, remote Dir, statePath string, opts *SyncOptions) (*SyncResult, error) {
+	if opts == nil {
+		opts = new(SyncOptions)
+	}
+
+	state, err := openSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	defer state.close()
+
+	if opts.ProcessNew {
+		for _, d := range []Dir{local, remote} {
+			if _, err := d.Unseen(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	localMsgs, localMalformed, err := walkKeysMalformed(local)
+	if err != nil {
+		return nil, err
+	}
+	remoteMsgs, remoteMalformed, err := walkKeysMalformed(remote)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.flags) > 0 && !opts.AllowEmpty {
+		for d, msgs := range map[Dir]map[string]*Message{local: localMsgs, remote: remoteMsgs} {
+			if len(msgs) == 0 {
+				return nil, fmt.Errorf("maildir: %q is empty, but %v messages were synchronized", d, len(state.flags))
+			}
+		}
+	}
+	errs := append(localMalformed, remoteMalformed...)
+	state.keepDeleted = len(errs) > 0
+
+	set := make(map[string]struct{})
+	for _, m := range []map[string]*Message{localMsgs, remoteMsgs} {
+		for key := range m {
+			set[key] = struct{}{}
+		}
+	}
+	for key := range state.flags {
+		set[key] = struct{}{}
+	}
+	keys := slices.Collect(maps.Keys(set))
+	slices.SortFunc(keys, compareKeys)
+
+	res := new(SyncResult)
+	for _, key := range keys {
+		err := state.syncMessage(res, opts, key, localMsgs[key], remoteMsgs[key], local, remote)
+		var msgErr *MessageError
+		if errors.As(err, &msgErr) {
+			errs = append(errs, err)
+		} else if err != nil {
+			return res, err
+		}
+	}
+
+	if err := state.save(); err != nil {
+		return res, err
+	}
+	return res, errors.Join(errs...)
+}
+
+// syncMessage synchronizes a single message. localMsg and remoteMsg are nil
+// if the message is missing on a side. Errors on the message are returned as
+// *MessageError, other errors are fatal.
+func (s *syncState) syncMessage(res *SyncResult, opts *SyncOptions, key string, localMsg, remoteMsg *Message, local, remote Dir) error {
+	synced, known := s.flags[key]
+	msgErr := func(err error) error {
+		if err == nil {
+			return nil
+		}
+		return &MessageError{key, err}
+	}
+
+	switch {
+	case !known && localMsg != nil && remoteMsg != nil:
+		// copied during an interrupted synchronization, or by someone else
+		return s.updateFlags(res, key, localMsg, remoteMsg, localMsg.flags.Add(remoteMsg.flags...))
+	case !known && localMsg != nil:
+		if err := msgErr(localMsg.copyWithKey(remote, key, &opts.Copy)); err != nil {
+			return err
+		}
+		res.Pushed = append(res.Pushed, key)
+		return s.set(key, localMsg.flags)
+	case !known && remoteMsg != nil:
+		if err := msgErr(remoteMsg.copyWithKey(local, key, &opts.Copy)); err != nil {
+			return err
+		}
+		res.Pulled = append(res.Pulled, key)
+		return s.set(key, remoteMsg.flags)
+	case (localMsg == nil) != (remoteMsg == nil) && s.keepDeleted:
+		return nil
+	case localMsg == nil && remoteMsg != nil:
+		if err := msgErr(removeMissing(remoteMsg)); err != nil {
+			return err
+		}
+		res.RemovedRemote = append(res.RemovedRemote, key)
+		return s.remove(key)
+	case localMsg != nil && remoteMsg == nil:
+		if err := msgErr(removeMissing(localMsg)); err != nil {
+			return err
+		}
+		res.RemovedLocal = append(res.RemovedLocal, key)
+		return s.remove(key)
+	case localMsg == nil && remoteMsg == nil:
+		return s.remove(key)
+	}
+
+	localChanged := !localMsg.flags.Equal(synced)
+	remoteChanged := !remoteMsg.flags.Equal(synced)
+	flags := localMsg.flags
+	switch {
+	case localChanged && remoteChanged && !localMsg.flags.Equal(remoteMsg.flags):
+		switch opts.Conflict {
+		case ConflictPreferLocal:
+			flags = localMsg.flags
+		case ConflictPreferRemote:
+			flags = remoteMsg.flags
+		default:
+			flags = mergeFlags(synced, localMsg.flags, remoteMsg.flags)
+		}
+		res.Conflicts = append(res.Conflicts, SyncConflict{
+			Key:      key,
+			Local:    localMsg.flags,
+			Remote:   remoteMsg.flags,
+			Resolved: flags,
+		})
+	case remoteChanged:
+		flags = remoteMsg.flags
+	}
+	return s.updateFlags(res, key, localMsg, remoteMsg, flags)
+}
+
+// updateFlags sets the flags on both sides and records them.
+func (s *syncState) updateFlags(res *SyncResult, key string, localMsg, remoteMsg *Message, flags Flags) error {
+	updated := false
+	for _, msg := range []*Message{localMsg, remoteMsg} {
+		if msg.flags.Equal(flags) {
+			continue
+		}
+		if err := msg.SetFlags(flags); err != nil {
+			return &MessageError{key, err}
+		}
+		updated = true
+	}
+	if updated {
+		res.Updated = append(res.Updated, key)
+	}
+	if synced, ok := s.flags[key]; ok && synced.Equal(flags) {
+		return nil
+	}
+	return s.set(key, flags)
+}
+
+// mergeFlags returns base with the flags added to local or remote, and
+// without the flags removed from local or remote.
+func mergeFlags(base, local, remote Flags) Flags {
+	flags := NewFlags(base...)
+	for _, changed := range []Flags{local, remote} {
+		for _, f := range changed {
+			if !base.Has(f) {
+				flags = flags.Add(f)
+			}
+		}
+		for _, f := range base {
+			if !changed.Has(f) {
+				flags = flags.Remove(f)
+			}
+		}
+	}
+	return flags
+}
+
+// removeMissing removes a message, ignoring the error if it is already gone.
+func removeMissing(msg *Message) error {
+	err := msg.Remove()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// copyWithKey copies the message to the target Maildir, keeping its key. If
+// the target already has a message with this key, it is left untouched.
+func (msg *Message) copyWithKey(target Dir, key string, opts *CopyOptions) error {
+	if _, err := target.filenameByKey(key); err == nil {
+		return nil
+	}
+	basename := key + string(separator) + formatInfo(msg.flags)
+	tmpFilename := filepath.Join(string(target), "tmp", key)
+	os.Remove(tmpFilename) // left by an interrupted synchronization
+	return msg.retry(func() error {
+		return opts.Strategy.copy(msg.filename, tmpFilename, filepath.Join(string(target), "cur", basename))
+	})
+}
+
+// syncState is the state of the last synchronization: the flags of the
+// messages synchronized on both sides, by key.
+type syncState struct {
+	path    string
+	flags   map[string]Flags
+	journal *os.File
+
+	keepDeleted bool // don't propagate deletions
+}
+
+func (s *syncState) journalPath() string {
+	return s.path + ".journal"
+}
+
+// openSyncState loads the state file and replays the journal.
+func openSyncState(path string) (*syncState, error) {
+	s := &syncState{path: path, flags: make(map[string]Flags)}
+
+	f, err := os.Open(path)
+	if err == nil {
+		err = s.read(f, true)
+		f.Close()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f, err = os.Open(s.journalPath())
+	if err == nil {
+		err = s.read(f, false)
+		f.Close()
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.journal, err = os.OpenFile(s.journalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// read reads state or journal entries. A journal might end with a truncated
+// entry, which is ignored.
+func (s *syncState) read(f *os.File, isState bool) error {
+	scanner := bufio.NewScanner(f)
+	if isState {
+		if !scanner.Scan() || scanner.Text() != syncStateHeader {
+			return fmt.Errorf("maildir: invalid sync state file %q", s.path)
+		}
+	}
+	for scanner.Scan() {
+		op, rest, _ := strings.Cut(scanner.Text(), "\t")
+		key, flags, _ := strings.Cut(rest, "\t")
+		switch {
+		case op == "+" && key != "":
+			s.flags[key] = parseFlags(flags)
+		case op == "-" && key != "":
+			delete(s.flags, key)
+		case !isState:
+			// truncated entry
+		default:
+			return fmt.Errorf("maildir: invalid sync state file %q", s.path)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *syncState) writeEntry(entry string) error {
+	if _, err := s.journal.WriteString(entry + "\n"); err != nil {
+		return err
+	}
+	return s.journal.Sync()
+}
+
+func (s *syncState) set(key string, flags Flags) error {
+	s.flags[key] = flags
+	return s.writeEntry("+\t" + key + "\t" + formatFlags(flags))
+}
+
+func (s *syncState) remove(key string) error {
+	delete(s.flags, key)
+	return s.writeEntry("-\t" + key)
+}
+
+// save writes the state file atomically and clears the journal.
+func (s *syncState) save() error {
+	tmpPath := s.path + ".tmp"
+	os.Remove(tmpPath) // left by an interrupted synchronization
+	err := writeFile(tmpPath, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		fmt.Fprintln(bw, syncStateHeader)
+		for _, key := range slices.Sorted(maps.Keys(s.flags)) {
+			fmt.Fprintf(bw, "+\t%s\t%s\n", key, formatFlags(s.flags[key]))
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return s.journal.Truncate(0)
+}
+
+func formatFlags(flags Flags) string {
+	var sb strings.Builder
+	for _, f := range NewFlags(flags...) {
+		sb.WriteRune(rune(f))
+	}
+	return sb.String()
+}
+
+func parseFlags(s string) Flags {
+	var flags []Flag
+	for _, r := range s {
+		flags = append(flags, Flag(r))
+	}
+	return NewFlags(flags...)
+}
+
+func (s *syncState) close() error {
+	return s.journal.Close()
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	t.Parallel()
+	local := Dir(t.TempDir())
+	remote := Dir(t.TempDir())
+	for _, d := range []Dir{local, remote} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statePath := filepath.Join(t.TempDir(), "state")
+
+	appendMessage := func(d Dir, s string) *Message {
+		msg, err := d.Append(strings.NewReader(s), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	sync := func() *SyncResult {
+		t.Helper()
+		res, err := Sync(local, remote, statePath, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	flagsOf := func(d Dir, key string) Flags {
+		t.Helper()
+		msg, err := d.MessageByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Flags()
+	}
+
+	a := appendMessage(local, "Subject: a\r\n\r\nlocal\r\n").Key()
+	b := appendMessage(remote, "Subject: b\r\n\r\nremote\r\n").Key()
+	res := sync()
+	if !slices.Equal(res.Pushed, []string{a}) || !slices.Equal(res.Pulled, []string{b}) {
+		t.Errorf("Pushed = %v, Pulled = %v, want %v, %v", res.Pushed, res.Pulled, a, b)
+	}
+	if msg, err := remote.MessageByKey(a); err != nil {
+		t.Fatal(err)
+	} else if b, err := os.ReadFile(msg.Filename()); err != nil || !strings.Contains(string(b), "local") {
+		t.Errorf("pushed message content = %q, %v", b, err)
+	}
+
+	// nothing to do
+	res = sync()
+	if len(res.Pushed)+len(res.Pulled)+len(res.Updated) != 0 {
+		t.Errorf("second Sync() = %+v, want no changes", res)
+	}
+
+	// flag changes on one side
+	setFlags := func(d Dir, key string, flags ...Flag) {
+		t.Helper()
+		msg, err := d.MessageByKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := msg.SetFlags(flags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setFlags(local, a, FlagSeen)
+	setFlags(remote, b, FlagFlagged)
+	res = sync()
+	if len(res.Updated) != 2 || len(res.Conflicts) != 0 {
+		t.Errorf("Sync() = %+v, want 2 updates", res)
+	}
+	if flags := flagsOf(remote, a); !flags.Equal(NewFlags(FlagSeen)) {
+		t.Errorf("remote flags of a = %v", flags)
+	}
+	if flags := flagsOf(local, b); !flags.Equal(NewFlags(FlagFlagged)) {
+		t.Errorf("local flags of b = %v", flags)
+	}
+
+	// flag changes on both sides
+	setFlags(local, a, FlagSeen, FlagReplied)
+	setFlags(remote, a)
+	res = sync()
+	if len(res.Conflicts) != 1 || res.Conflicts[0].Key != a {
+		t.Fatalf("Conflicts = %+v, want a conflict on %v", res.Conflicts, a)
+	}
+	want := NewFlags(FlagReplied)
+	if !res.Conflicts[0].Resolved.Equal(want) {
+		t.Errorf("Resolved = %v, want %v", res.Conflicts[0].Resolved, want)
+	}
+	for _, d := range []Dir{local, remote} {
+		if flags := flagsOf(d, a); !flags.Equal(want) {
+			t.Errorf("flags of a in %v = %v, want %v", d, flags, want)
+		}
+	}
+
+	// deletions
+	msg, err := local.MessageByKey(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	res = sync()
+	if !slices.Equal(res.RemovedRemote, []string{a}) {
+		t.Errorf("RemovedRemote = %v, want %v", res.RemovedRemote, a)
+	}
+	if _, err := remote.MessageByKey(a); err == nil {
+		t.Error("deleted message still in remote")
+	}
+}
+
+func TestSync_resume(t *testing.T) {
+	t.Parallel()
+	local := Dir(t.TempDir())
+	remote := Dir(t.TempDir())
+	for _, d := range []Dir{local, remote} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statePath := filepath.Join(t.TempDir(), "state")
+
+	a, err := local.Append(strings.NewReader("Subject: a\r\n\r\n"), []Flag{FlagSeen}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := local.Append(strings.NewReader("Subject: b\r\n\r\n"), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted after copying a and journaling it, then copying b
+	if err := a.copyWithKey(remote, a.Key(), &CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.copyWithKey(remote, b.Key(), &CopyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	journal := "+\t" + a.Key() + "\tS\n+\ttrunc"
+	if err := os.WriteFile(statePath+".journal", []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Sync(local, remote, statePath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Pushed)+len(res.Pulled)+len(res.Updated) != 0 {
+		t.Errorf("Sync() = %+v, want no changes", res)
+	}
+	for _, d := range []Dir{local, remote} {
+		msgs, err := d.Messages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 2 {
+			t.Errorf("%v has %v messages, want 2", d, len(msgs))
+		}
+	}
+
+	state, err := openSyncState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.close()
+	if len(state.flags) != 2 {
+		t.Errorf("state has %v messages, want 2", len(state.flags))
+	}
+	if fi, err := os.Stat(statePath + ".journal"); err != nil || fi.Size() != 0 {
+		t.Errorf("journal not cleared: %v", err)
+	}
+}
+
+func TestSync_malformed(t *testing.T) {
+	t.Parallel()
+	local := Dir(t.TempDir())
+	remote := Dir(t.TempDir())
+	for _, d := range []Dir{local, remote} {
+		if err := d.Init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	statePath := filepath.Join(t.TempDir(), "state")
+
+	var keys []string
+	for _, s := range []string{"Subject: a\r\n\r\n", "Subject: b\r\n\r\n"} {
+		msg, err := local.Append(strings.NewReader(s), nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, msg.Key())
+	}
+	if _, err := Sync(local, remote, statePath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a malformed file name hides the message
+	msg, err := local.MessageByKey(keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(msg.Filename(), filepath.Join(string(local), "cur", keys[0])); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Sync(local, remote, statePath, nil)
+	if err == nil {
+		t.Error("Sync() with a malformed file succeeded")
+	}
+	if res == nil || len(res.RemovedRemote) != 0 {
+		t.Errorf("Sync() = %+v, want no deletions", res)
+	}
+	if _, err := remote.MessageByKey(keys[0]); err != nil {
+		t.Errorf("message removed from remote: %v", err)
+	}
+
+	// all the messages are gone
+	if err := os.RemoveAll(filepath.Join(string(local), "cur")); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sync(local, remote, statePath, nil); err == nil {
+		t.Error("Sync() with an empty Maildir succeeded")
+	}
+	for _, key := range keys {
+		if _, err := remote.MessageByKey(key); err != nil {
+			t.Errorf("message removed from remote: %v", err)
+		}
+	}
+
+	res, err = Sync(local, remote, statePath, &SyncOptions{AllowEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.RemovedRemote) != 2 {
+		t.Errorf("RemovedRemote = %v, want 2 messages", res.RemovedRemote)
+	}
+}
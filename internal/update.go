@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A MessageError occurs when an operation on a single message of a batch
+// fails.
+type MessageError struct {
+	Key string // the key of the message
+	Err error  // the underlying error
+}
+
+func (e *MessageError) Error() string {
+	return fmt.Sprintf("maildir: message %q: %v", e.Key, e.Err)
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// MatchKeys returns a filter matching the messages with the given keys.
+func MatchKeys(keys ...string) func(*Message) bool {
+	set := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		set[k] = struct{}{}
+	}
+	return func(msg *Message) bool {
+		_, ok := set[msg.Key()]
+		return ok
+	}
+}
+
+// UpdateFlagsOptions contains options for Dir.UpdateFlags.
+type UpdateFlagsOptions struct {
+	// Parallelism is the maximum number of messages renamed concurrently. If
+	// it is lower than 2, messages are renamed one after the other.
+	Parallelism int
+}
+
+// UpdateFlags adds and removes flags on all the messages in cur matched by
+// the filter. A nil filter matches every message.
+//
+// The directory is scanned once, and only the messages whose flags actually
+// change are renamed. The renamed messages are returned. Failures on single
+// messages do not stop the update: they are returned as *MessageError, joined
+// with any error encountered while scanning the directory.
+func (d Dir) UpdateFlags(filter func(*Message) bool, add, remove []Flag, opts *UpdateFlagsOptions) ([]*Message, error) {
+	if opts == nil {
+		opts = new(UpdateFlagsOptions)
+	}
+
+	var pending []*Message
+	walkErr := d.Walk(func(msg *Message) error {
+		if filter != nil && !filter(msg) {
+			return nil
+		}
+		if !msg.flags.Add(add...).Remove(remove...).Equal(msg.flags) {
+			pending = append(pending, msg)
+		}
+		return nil
+	})
+
+	parallelism := min(max(opts.Parallelism, 1), max(len(pending), 1))
+	errs := make([]error, len(pending))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, msg := range pending {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := msg.updateFlags(func(cur Flags) Flags {
+				return cur.Add(add...).Remove(remove...)
+			})
+			if err != nil {
+				errs[i] = &MessageError{msg.Key(), err}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var updated []*Message
+	for i, msg := range pending {
+		if errs[i] == nil {
+			updated = append(updated, msg)
+		}
+	}
+	return updated, errors.Join(append([]error{walkErr}, errs...)...)
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestDir_UpdateFlags(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		makeDelivery(t, d, fmt.Sprintf("message number %d", i), nil)
+	}
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range msgs[:5] {
+		if err := msg.SetFlags([]Flag{FlagSeen}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	updated, err := d.UpdateFlags(nil, []Flag{FlagSeen}, []Flag{FlagDraft}, &UpdateFlagsOptions{Parallelism: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 15 {
+		t.Errorf("UpdateFlags() updated %d messages, want 15", len(updated))
+	}
+	all, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range all {
+		if !slices.Equal(msg.Flags(), Flags{FlagSeen}) {
+			t.Errorf("message %q has flags %v, want {FlagSeen}", msg.Key(), msg.Flags())
+		}
+	}
+
+	keys := []string{msgs[0].Key(), msgs[1].Key()}
+	updated, err = d.UpdateFlags(MatchKeys(keys...), []Flag{FlagFlagged}, []Flag{FlagSeen}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 2 {
+		t.Fatalf("UpdateFlags() updated %d messages, want 2", len(updated))
+	}
+	for _, msg := range updated {
+		if !slices.Contains(keys, msg.Key()) {
+			t.Errorf("unexpected message %q updated", msg.Key())
+		}
+		if !slices.Equal(msg.Flags(), Flags{FlagFlagged}) {
+			t.Errorf("message %q has flags %v, want {FlagFlagged}", msg.Key(), msg.Flags())
+		}
+	}
+}
+
+func TestDir_UpdateFlags_failure(t *testing.T) {
+	t.Parallel()
+	d := Dir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	makeDelivery(t, d, "a message", nil)
+	msgs, err := d.Unseen()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := func(msg *Message) bool {
+		// the message disappears between the scan and the rename
+		if err := os.Remove(msg.Filename()); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	}
+	updated, err := d.UpdateFlags(filter, []Flag{FlagSeen}, nil, nil)
+	if len(updated) != 0 {
+		t.Errorf("UpdateFlags() updated %d messages, want 0", len(updated))
+	}
+	var msgErr *MessageError
+	if !errors.As(err, &msgErr) {
+		t.Fatalf("want *MessageError, but UpdateFlags() = %v", err)
+	}
+	if msgErr.Key != msgs[0].Key() {
+		t.Errorf("MessageError.Key = %q, want %q", msgErr.Key, msgs[0].Key())
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want os.ErrNotExist, but UpdateFlags() = %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+// Package lmtp implements a go-smtp backend delivering messages to Maildirs
+// over LMTP (RFC 2033).
+//
+// Each recipient is mapped to a Maildir by a Resolver when the RCPT command
+// is received. go-smtp undoes the dot-stuffing of the message, which is then
+// stored with LF line endings and the S= and W= size attributes. After DATA,
+// a status is returned for each recipient, depending on the outcome of its
+// delivery: a recipient whose disk quota is exceeded gets ErrMailboxFull,
+// while the others may still succeed.
+//
+// The server should have smtp.Server.LMTP set: over SMTP, a single status is
+// returned for all the recipients.
+package lmtp
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/emersion/go-maildir/maildirpp"
+	"github.com/emersion/go-smtp"
+)
+
+// ErrUnknownRecipient may be returned by a Resolver when the recipient has no
+// Maildir.
+var ErrUnknownRecipient = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user",
+}
+
+// ErrMailboxFull is returned for a recipient whose disk quota is exceeded. It
+// may also be returned by a Resolver.
+var ErrMailboxFull = &smtp.SMTPError{
+	Code:         552,
+	EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+	Message:      "Mailbox full",
+}
+
+var errSystemFull = &smtp.SMTPError{
+	Code:         452,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+	Message:      "Mail system full",
+}
+
+// Resolver returns the path to the Maildir of a recipient. Errors of type
+// *smtp.SMTPError are returned to the client as is, the other ones are
+// reported as temporary failures.
+type Resolver func(rcpt string) (dir string, err error)
+
+// Options contains options for New.
+type Options struct {
+	// If not nil, the database used to suppress duplicate deliveries. The
+	// deliveries are told apart by recipient address.
+	Duplicates *maildirpp.DuplicateDB
+	// The action taken on duplicates, and the flags of the duplicates
+	// delivered with DuplicateTag.
+	DuplicateAction maildirpp.DuplicateAction
+	DuplicateFlags  []maildirpp.Flag
+}
+
+// Backend delivers the messages received by an LMTP server to Maildirs.
+type Backend struct {
+	resolve Resolver
+	opts    Options
+}
+
+var _ smtp.Backend = (*Backend)(nil)
+
+// New creates a new backend, mapping recipients to Maildirs with resolve.
+func New(resolve Resolver, opts *Options) *Backend {
+	if opts == nil {
+		opts = new(Options)
+	}
+	return &Backend{resolve: resolve, opts: *opts}
+}
+
+// NewSession implements smtp.Backend.
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{backend: be}, nil
+}
+
+// statusError converts an error to the status returned to the client.
+func statusError(err error, message string) *smtp.SMTPError {
+	var smtpErr *smtp.SMTPError
+	switch {
+	case errors.As(err, &smtpErr):
+		return smtpErr
+	case errors.Is(err, syscall.EDQUOT):
+		return ErrMailboxFull
+	case errors.Is(err, syscall.ENOSPC):
+		return errSystemFull
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      message,
+	}
+}
@@ -0,0 +1,192 @@
+package lmtp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/emersion/go-maildir/maildirpp"
+	"github.com/emersion/go-smtp"
+)
+
+const testMessage = "From: alice@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n" +
+	"Hi Bob!\r\n" +
+	".\r\n" +
+	"Bye\r\n"
+
+// newTestServer serves an LMTP backend on a local Unix socket, and returns a
+// function connecting clients.
+func newTestServer(t *testing.T, resolve Resolver) func() *smtp.Client {
+	s := smtp.NewServer(New(resolve, nil))
+	s.LMTP = true
+	s.Domain = "localhost"
+
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "lmtp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+
+	return func() *smtp.Client {
+		t.Helper()
+		conn, err := net.Dial("unix", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := smtp.NewClientLMTP(conn)
+		t.Cleanup(func() { c.Close() })
+		if err := c.Hello("localhost"); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+}
+
+func newTestDir(t *testing.T) *maildirpp.Dir {
+	d := maildirpp.NewDir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+	bob, carol := newTestDir(t), newTestDir(t)
+	dirs := map[string]string{
+		"bob@example.org":   string(bob.Dir),
+		"carol@example.org": string(carol.Dir),
+		"dave@example.org":  filepath.Join(t.TempDir(), "missing"),
+	}
+	c := newTestServer(t, func(rcpt string) (string, error) {
+		dir, ok := dirs[rcpt]
+		if !ok {
+			return "", ErrUnknownRecipient
+		}
+		return dir, nil
+	})()
+
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"bob@example.org", "carol@example.org", "dave@example.org"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%q) = %v", rcpt, err)
+		}
+	}
+	var smtpErr *smtp.SMTPError
+	if err := c.Rcpt("eve@example.org", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("Rcpt() for unknown recipient = %v, want 550", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, testMessage); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := w.CloseWithLMTPResponse()
+	var lmtpErr smtp.LMTPDataError
+	if !errors.As(err, &lmtpErr) {
+		t.Fatalf("CloseWithLMTPResponse() = %v, want LMTPDataError", err)
+	}
+	if len(resp) != 2 || resp["bob@example.org"] == nil || resp["carol@example.org"] == nil {
+		t.Errorf("CloseWithLMTPResponse() = %v, want success for bob and carol", resp)
+	}
+	if smtpErr := lmtpErr["dave@example.org"]; smtpErr == nil || smtpErr.Code != 451 {
+		t.Errorf("status for dave = %v, want 451", lmtpErr["dave@example.org"])
+	}
+
+	want := strings.ReplaceAll(testMessage, "\r\n", "\n")
+	for _, d := range []*maildirpp.Dir{bob, carol} {
+		msgs, err := d.Unseen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msgs) != 1 {
+			t.Fatalf("Unseen() = %v messages, want 1", len(msgs))
+		}
+		attrs := msgs[0].Attributes()
+		if s, _ := attrs.Get("S"); s != strconv.Itoa(len(want)) {
+			t.Errorf("S= attribute = %q, want %v", s, len(want))
+		}
+		if w, _ := attrs.Get("W"); w != strconv.Itoa(len(testMessage)) {
+			t.Errorf("W= attribute = %q, want %v", w, len(testMessage))
+		}
+
+		r, err := msgs[0].Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("message content = %q, want %q", b, want)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{err: &fs.PathError{Op: "write", Path: "new", Err: syscall.EDQUOT}, code: 552},
+		{err: &fs.PathError{Op: "write", Path: "new", Err: syscall.ENOSPC}, code: 452},
+		{err: ErrUnknownRecipient, code: 550},
+		{err: errors.New("oops"), code: 451},
+	} {
+		if err := statusError(tc.err, "Failed"); err.Code != tc.code {
+			t.Errorf("statusError(%v) = %v, want code %v", tc.err, err, tc.code)
+		}
+	}
+}
+
+func TestLFWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &lfWriter{w: &buf}
+	for _, s := range []string{"a\r", "\nb\r", "c\r\n\r", "\n\r"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a\nb\rc\n\n\r"; got != want {
+		t.Errorf("lfWriter wrote %q, want %q", got, want)
+	}
+}
+
+func TestLFWriter_size(t *testing.T) {
+	// The CRLF is split across writes, so the LF reaches the size counter at
+	// the start of a write, after the CR was dropped.
+	size := maildirpp.DovecotMessageRFC822Size()
+	w := &lfWriter{w: size}
+	for _, s := range []string{"abc\r", "\ndef\r\n"} {
+		if _, err := io.WriteString(w, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	size.Close()
+	if got, want := size.Compute(), "10"; got != want {
+		t.Errorf("W= size = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package lmtp
+
+import (
+	"io"
+
+	"github.com/emersion/go-maildir/maildirpp"
+	"github.com/emersion/go-smtp"
+)
+
+type recipient struct {
+	addr string
+	dir  string
+}
+
+// session is an LMTP session. It accumulates the recipients of the current
+// message.
+type session struct {
+	backend *Backend
+	rcpts   []recipient
+}
+
+var _ smtp.LMTPSession = (*session)(nil)
+
+func (sess *session) Reset() {
+	sess.rcpts = nil
+}
+
+func (sess *session) Logout() error {
+	return nil
+}
+
+func (sess *session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (sess *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	dir, err := sess.backend.resolve(to)
+	if err != nil {
+		return statusError(err, "Failed to resolve recipient")
+	}
+	sess.rcpts = append(sess.rcpts, recipient{addr: to, dir: dir})
+	return nil
+}
+
+// Data delivers the message when the server is not in LMTP mode. The first
+// delivery error is returned.
+func (sess *session) Data(r io.Reader) error {
+	var status firstStatus
+	if err := sess.LMTPData(r, &status); err != nil {
+		return err
+	}
+	return status.err
+}
+
+// LMTPData delivers the message to each recipient. Recipients whose delivery
+// fails do not prevent the delivery to the others.
+func (sess *session) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	deliveries := make([]*delivery, len(sess.rcpts))
+	for i, rcpt := range sess.rcpts {
+		deliveries[i] = sess.newDelivery(rcpt)
+	}
+
+	w := &lfWriter{w: fanout(deliveries)}
+	_, err := io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		// the message is incomplete
+		for _, d := range deliveries {
+			if d.err == nil {
+				d.Abort()
+			}
+		}
+		return err
+	}
+
+	for _, d := range deliveries {
+		if d.err == nil {
+			d.err = d.Close()
+		}
+		if d.err != nil {
+			status.SetStatus(d.rcpt.addr, statusError(d.err, "Failed to deliver message"))
+		} else {
+			status.SetStatus(d.rcpt.addr, nil)
+		}
+	}
+	return nil
+}
+
+// delivery is the delivery of a message to a recipient. Once err is set, the
+// delivery is aborted.
+type delivery struct {
+	*maildirpp.Delivery
+	rcpt recipient
+	err  error
+}
+
+func (sess *session) newDelivery(rcpt recipient) *delivery {
+	opts := &maildirpp.DeliveryOptions{
+		Duplicates:      sess.backend.opts.Duplicates,
+		Recipient:       rcpt.addr,
+		DuplicateAction: sess.backend.opts.DuplicateAction,
+		DuplicateFlags:  sess.backend.opts.DuplicateFlags,
+	}
+	d, err := maildirpp.NewDeliveryWithOptions(rcpt.dir, opts, nil,
+		maildirpp.DovecotMessageSize(), maildirpp.DovecotMessageRFC822Size())
+	return &delivery{Delivery: d, rcpt: rcpt, err: err}
+}
+
+// fanout writes to all the deliveries which have not failed. Write errors
+// are recorded in the deliveries, and never returned.
+type fanout []*delivery
+
+func (f fanout) Write(p []byte) (int, error) {
+	for _, d := range f {
+		if d.err != nil {
+			continue
+		}
+		if _, err := d.Write(p); err != nil {
+			d.err = err
+			d.Abort()
+		}
+	}
+	return len(p), nil
+}
+
+// lfWriter converts CRLF line endings to LF. Close writes a trailing CR.
+type lfWriter struct {
+	w  io.Writer
+	cr bool // the last byte written was a CR
+}
+
+func (w *lfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if w.cr && c != '\n' {
+			buf = append(buf, '\r')
+		}
+		w.cr = c == '\r'
+		if !w.cr {
+			buf = append(buf, c)
+		}
+	}
+	if _, err := w.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *lfWriter) Close() error {
+	if !w.cr {
+		return nil
+	}
+	w.cr = false
+	_, err := w.w.Write([]byte{'\r'})
+	return err
+}
+
+// firstStatus records the first error set.
+type firstStatus struct {
+	err error
+}
+
+func (s *firstStatus) SetStatus(rcpt string, err error) {
+	if s.err == nil && err != nil {
+		s.err = err
+	}
+}
@@ -8,6 +8,7 @@ package maildir
 
 import (
 	"io"
+	"time"
 
 	"github.com/emersion/go-maildir/internal"
 )
@@ -15,9 +16,61 @@ import (
 type KeyError = internal.KeyError
 type FlagError = internal.FlagError
 type MailfileError = internal.MailfileError
+type MessageError = internal.MessageError
+type PartError = internal.PartError
 type Message = internal.Message
+type Header = internal.Header
+type MessageReader = internal.MessageReader
+type Entity = internal.Entity
+type Cache = internal.Cache
+type Index = internal.Index
+type UpdateFlagsOptions = internal.UpdateFlagsOptions
+type ExpungeOptions = internal.ExpungeOptions
+type DuplicateOptions = internal.DuplicateOptions
+type DedupeOptions = internal.DedupeOptions
+type CopyOptions = internal.CopyOptions
+type CreateOptions = internal.CreateOptions
+type SearchCriteria = internal.SearchCriteria
+type SearchCriteriaHeaderField = internal.SearchCriteriaHeaderField
+type SortCriterion = internal.SortCriterion
+type Snapshot = internal.Snapshot
+type SnapshotEntry = internal.SnapshotEntry
+type SnapshotDiff = internal.SnapshotDiff
+type SyncOptions = internal.SyncOptions
+type SyncResult = internal.SyncResult
+type SyncConflict = internal.SyncConflict
+
+type CopyStrategy = internal.CopyStrategy
+
+const (
+	CopyAuto   CopyStrategy = internal.CopyAuto
+	CopyLink   CopyStrategy = internal.CopyLink
+	CopyClone  CopyStrategy = internal.CopyClone
+	CopyStream CopyStrategy = internal.CopyStream
+)
+
+type ConflictPolicy = internal.ConflictPolicy
+
+const (
+	ConflictMerge        ConflictPolicy = internal.ConflictMerge
+	ConflictPreferLocal  ConflictPolicy = internal.ConflictPreferLocal
+	ConflictPreferRemote ConflictPolicy = internal.ConflictPreferRemote
+)
+
+type SortKey = internal.SortKey
+
+const (
+	SortArrival SortKey = internal.SortArrival
+	SortCc      SortKey = internal.SortCc
+	SortDate    SortKey = internal.SortDate
+	SortFrom    SortKey = internal.SortFrom
+	SortSize    SortKey = internal.SortSize
+	SortSubject SortKey = internal.SortSubject
+	SortTo      SortKey = internal.SortTo
+)
 
 type Flag = internal.Flag
+type Flags = internal.Flags
 
 const (
 	FlagPassed  Flag = internal.FlagPassed
@@ -46,14 +99,104 @@ func (d *Dir) Create(flags []Flag) (*Message, io.WriteCloser, error) {
 	return d.Dir.Create(flags, nil)
 }
 
+// CreateWithOptions inserts a new message into the Maildir, like Create.
+func (d *Dir) CreateWithOptions(flags []Flag, opts *CreateOptions) (*Message, io.WriteCloser, error) {
+	return d.Dir.CreateWithOptions(flags, nil, opts)
+}
+
+// Append inserts a new message into the Maildir, with the content read from
+// r, and returns it once committed.
+//
+// If an error occurs, the temporary file is removed and the message is not
+// inserted.
+func (d *Dir) Append(r io.Reader, flags []Flag, opts *CreateOptions) (*Message, error) {
+	return d.Dir.Append(r, flags, nil, opts)
+}
+
 // Delivery represents an ongoing message delivery to the mailbox. It
 // implements the io.WriteCloser interface. On Close the underlying file is
 // moved/relinked to new.
 //
 // Multiple processes can perform a delivery on the same Maildir concurrently.
 type Delivery = internal.Delivery
+type DeliveryOptions = internal.DeliveryOptions
+
+// DuplicateDB records the messages delivered to each recipient, to detect
+// duplicate deliveries.
+type DuplicateDB = internal.DuplicateDB
+
+// OpenDuplicateDB opens the duplicate database in the directory dir, and
+// creates it if needed. Records expire after expiry, or never if it is zero.
+func OpenDuplicateDB(dir string, expiry time.Duration) (*DuplicateDB, error) {
+	return internal.OpenDuplicateDB(dir, expiry)
+}
+
+type DuplicateAction = internal.DuplicateAction
+
+const (
+	DuplicateSkip DuplicateAction = internal.DuplicateSkip
+	DuplicateTag  DuplicateAction = internal.DuplicateTag
+)
 
 // NewDelivery creates a new Delivery.
 func NewDelivery(d string) (*Delivery, error) {
 	return internal.NewDelivery(d, nil)
 }
+
+// NewDeliveryWithOptions creates a new Delivery, like NewDelivery.
+func NewDeliveryWithOptions(d string, opts *DeliveryOptions) (*Delivery, error) {
+	return internal.NewDeliveryWithOptions(d, opts, nil)
+}
+
+// Deliver delivers a new message to the Maildir d, with the content read from
+// r.
+//
+// If an error occurs, the temporary file is removed and the message is not
+// delivered.
+func Deliver(d string, r io.Reader) error {
+	return internal.Deliver(d, r, nil)
+}
+
+// NewFlags returns a set containing the given flags.
+func NewFlags(flags ...Flag) Flags {
+	return internal.NewFlags(flags...)
+}
+
+// ParseIMAPFlag returns the flag corresponding to an IMAP flag name.
+func ParseIMAPFlag(name string) (Flag, bool) {
+	return internal.ParseIMAPFlag(name)
+}
+
+// ParseIMAPFlags returns the set of flags corresponding to IMAP flag names.
+// Names without a Maildir equivalent are returned separately.
+func ParseIMAPFlags(names []string) (Flags, []string) {
+	return internal.ParseIMAPFlags(names)
+}
+
+// MatchKeys returns a filter matching the messages with the given keys.
+func MatchKeys(keys ...string) func(*Message) bool {
+	return internal.MatchKeys(keys...)
+}
+
+// SortMessages sorts messages according to the criteria, with the semantics
+// of RFC 5256 SORT.
+func SortMessages(msgs []*Message, criteria ...SortCriterion) error {
+	return internal.SortMessages(msgs, criteria...)
+}
+
+// BaseSubject returns the base subject of a decoded subject, as defined by
+// RFC 5256. isReply reports whether reply or forward markers were removed.
+func BaseSubject(subject string) (base string, isReply bool) {
+	return internal.BaseSubject(subject)
+}
+
+// Sync synchronizes two Maildirs in both directions, using the state of the
+// last synchronization stored in the file statePath.
+func Sync(local, remote *Dir, statePath string, opts *SyncOptions) (*SyncResult, error) {
+	return internal.Sync(local.Dir, remote.Dir, statePath, opts)
+}
+
+// Diff returns the changes from the snapshot from to the snapshot to.
+func Diff(from, to Snapshot) *SnapshotDiff {
+	return internal.Diff(from, to)
+}
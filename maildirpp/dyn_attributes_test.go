@@ -41,24 +41,31 @@ func TestDovecotMessageRFC822Size(t *testing.T) {
 		"test-carry-CRLF": {msg: "message\r\n", expected: 9},
 		"test-carry-CRCR": {msg: "message\r\r", expected: 9},
 		"test-carry-LFLF": {msg: "message\n\n", expected: 11},
+		"test-split-LF":   {msg: "message\nabcdef\n", expected: 17},
+		"test-split-CRLF": {msg: "message\r\nabcde\r\n", expected: 16},
+		"test-stale-CR":   {msg: "message\rabcdefgh\n", expected: 18},
 	}
 
 	for name, tc := range testCases {
 		t.Run(name, func(t *testing.T) {
-			dynAttr := DovecotMessageRFC822Size()
-
-			for c := range slices.Chunk([]byte(tc.msg), 8) {
-				_, _ = dynAttr.Write(c)
-			}
-			_ = dynAttr.Close()
-
-			count := dynAttr.Compute()
-			if count != fmt.Sprint(tc.expected) {
-				t.Fatalf("expected count: %d, actual count: %s", tc.expected, count)
-			}
-
-			if key := dynAttr.Key(); key != "W" {
-				t.Fatalf("unexpected key: %s", key)
+			// Splitting the message at every possible size must not
+			// change the result.
+			for size := 1; size <= max(len(tc.msg), 1); size++ {
+				dynAttr := DovecotMessageRFC822Size()
+
+				for c := range slices.Chunk([]byte(tc.msg), size) {
+					_, _ = dynAttr.Write(c)
+				}
+				_ = dynAttr.Close()
+
+				count := dynAttr.Compute()
+				if count != fmt.Sprint(tc.expected) {
+					t.Fatalf("chunk size %d: expected count: %d, actual count: %s", size, tc.expected, count)
+				}
+
+				if key := dynAttr.Key(); key != "W" {
+					t.Fatalf("unexpected key: %s", key)
+				}
 			}
 		})
 	}
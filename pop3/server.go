@@ -0,0 +1,164 @@
+// Package pop3 implements a POP3 server (RFC 1939) serving Maildirs.
+//
+// The messages in new are moved to cur when a session starts, and are listed
+// in delivery order. The size of a message is read from its W= attribute,
+// which counts line endings as CRLF like POP3 does, or from its S= attribute.
+// The unique ID of a message is derived from its key, which is stable.
+//
+// Messages deleted with DELE are flagged with FlagTrashed right away, and
+// removed when the client quits. If the connection is lost instead, the flag
+// is removed again.
+package pop3
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultTimeout is the default value of Options.Timeout, the minimum allowed
+// by RFC 1939.
+const defaultTimeout = 10 * time.Minute
+
+// ErrServerClosed is returned by Serve after Close is called.
+var ErrServerClosed = errors.New("pop3: server closed")
+
+// AuthFunc checks the credentials of a user, and returns the path to their
+// Maildir. It returns an error if the credentials are invalid.
+type AuthFunc func(username, password string) (dir string, err error)
+
+// Options contains options for New.
+type Options struct {
+	// The duration after which an inactive client is disconnected. If zero,
+	// 10 minutes is used.
+	Timeout time.Duration
+}
+
+// Server serves Maildirs over POP3.
+//
+// A Maildir can only be opened by one session at a time. Other programs can
+// keep delivering messages to it, they are picked up by the next session.
+type Server struct {
+	authenticate AuthFunc
+	timeout      time.Duration
+
+	mutex     sync.Mutex
+	locked    map[string]struct{} // Maildirs in use
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// New creates a new server, authenticating users with authenticate.
+func New(authenticate AuthFunc, opts *Options) *Server {
+	if opts == nil {
+		opts = new(Options)
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Server{
+		authenticate: authenticate,
+		timeout:      timeout,
+		locked:       make(map[string]struct{}),
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on ln and serves them, until Close is called or
+// ln fails. It always returns a non-nil error.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.listeners, ln)
+		s.mutex.Unlock()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single connection, and closes it when the session ends.
+func (s *Server) ServeConn(conn net.Conn) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		conn.Close()
+		return ErrServerClosed
+	}
+	s.conns[conn] = struct{}{}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	sess := newSession(s, conn)
+	defer sess.close()
+	return sess.serve()
+}
+
+// Close stops the listeners and closes the open connections. The pending
+// deletions of the sessions are discarded.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	var errs []error
+	for ln := range s.listeners {
+		if err := ln.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for conn := range s.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lock marks a Maildir as in use. It returns false if it already is.
+func (s *Server) lock(dir string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.locked[dir]; ok {
+		return false
+	}
+	s.locked[dir] = struct{}{}
+	return true
+}
+
+func (s *Server) unlock(dir string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.locked, dir)
+}
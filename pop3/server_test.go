@@ -0,0 +1,305 @@
+package pop3
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// testMessage uses LF line endings, its size on the wire is larger.
+const testMessage = "From: alice@example.org\n" +
+	"Subject: Hello\n" +
+	"\n" +
+	"Hi Bob!\n" +
+	".\n" +
+	"Bye\n"
+
+// testClient is a minimal POP3 client.
+type testClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+// cmd sends a command and returns the status line, without +OK or -ERR.
+func (c *testClient) cmd(ok bool, format string, args ...interface{}) string {
+	c.t.Helper()
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.status(ok)
+}
+
+func (c *testClient) status(ok bool) string {
+	c.t.Helper()
+	line, err := c.text.ReadLine()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	prefix := "-ERR"
+	if ok {
+		prefix = "+OK"
+	}
+	if !strings.HasPrefix(line, prefix) {
+		c.t.Fatalf("got %q, want %v", line, prefix)
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+}
+
+// multiline sends a command and returns the multi-line response.
+func (c *testClient) multiline(format string, args ...interface{}) string {
+	c.t.Helper()
+	c.cmd(true, format, args...)
+	b, err := c.text.ReadDotBytes()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return string(b)
+}
+
+// newTestServer serves the Maildir dir on a local listener, and returns a
+// function connecting clients.
+func newTestServer(t *testing.T, dir string) func() *testClient {
+	srv := New(func(username, password string) (string, error) {
+		if username != "bob" || password != "secret" {
+			return "", errors.New("invalid credentials")
+		}
+		return dir, nil
+	}, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	return func() *testClient {
+		t.Helper()
+		text, err := textproto.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { text.Close() })
+		c := &testClient{t: t, text: text}
+		c.status(true)
+		return c
+	}
+}
+
+func newTestDir(t *testing.T, n int) *maildirpp.Dir {
+	d := maildirpp.NewDir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		err := maildirpp.Deliver(string(d.Dir), strings.NewReader(testMessage), nil, maildirpp.DovecotMessageRFC822Size())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+func login(c *testClient) {
+	c.t.Helper()
+	c.cmd(true, "USER bob")
+	c.cmd(true, "PASS secret")
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+	d := newTestDir(t, 2)
+	c := newTestServer(t, string(d.Dir))()
+
+	c.cmd(true, "USER bob")
+	if s := c.cmd(false, "PASS wrong"); !strings.HasPrefix(s, "[AUTH]") {
+		t.Errorf("PASS with invalid credentials = %q, want [AUTH] code", s)
+	}
+	c.cmd(false, "STAT")
+	login(c)
+
+	if n, err := d.UnseenCount(); err != nil || n != 0 {
+		t.Errorf("UnseenCount() = %v, %v, want 0", n, err)
+	}
+
+	size := len(strings.ReplaceAll(testMessage, "\n", "\r\n"))
+	if s, want := c.cmd(true, "STAT"), "2 "+strconv.Itoa(2*size); s != want {
+		t.Errorf("STAT = %q, want %q", s, want)
+	}
+	if s, want := c.multiline("LIST"), "1 "+strconv.Itoa(size)+"\n2 "+strconv.Itoa(size)+"\n"; s != want {
+		t.Errorf("LIST = %q, want %q", s, want)
+	}
+	if s, want := c.cmd(true, "LIST 2"), "2 "+strconv.Itoa(size); s != want {
+		t.Errorf("LIST 2 = %q, want %q", s, want)
+	}
+	c.cmd(false, "LIST 3")
+
+	msgs, err := d.Sort(maildirpp.SortCriterion{Key: maildirpp.SortArrival})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uidl := c.multiline("UIDL")
+	for i, msg := range msgs {
+		key, _, _ := strings.Cut(msg.Key(), ",")
+		if want := strconv.Itoa(i+1) + " " + key + "\n"; !strings.Contains(uidl, want) {
+			t.Errorf("UIDL = %q, want line %q", uidl, want)
+		}
+	}
+
+	// ReadDotBytes undoes dot-stuffing and converts CRLF to LF
+	if s := c.multiline("RETR 1"); s != testMessage {
+		t.Errorf("RETR 1 = %q, want %q", s, testMessage)
+	}
+	if s, want := c.multiline("TOP 1 1"), "From: alice@example.org\nSubject: Hello\n\nHi Bob!\n"; s != want {
+		t.Errorf("TOP 1 1 = %q, want %q", s, want)
+	}
+	if s, want := c.multiline("TOP 1 0"), "From: alice@example.org\nSubject: Hello\n\n"; s != want {
+		t.Errorf("TOP 1 0 = %q, want %q", s, want)
+	}
+
+	c.cmd(true, "DELE 1")
+	c.cmd(false, "RETR 1")
+	c.cmd(false, "DELE 1")
+	if s, want := c.cmd(true, "STAT"), "1 "+strconv.Itoa(size); s != want {
+		t.Errorf("STAT after DELE = %q, want %q", s, want)
+	}
+	if err := msgs[0].Refresh(); err != nil {
+		t.Fatal(err)
+	} else if !msgs[0].Flags().Has(maildirpp.FlagTrashed) {
+		t.Errorf("deleted message not flagged with FlagTrashed")
+	}
+
+	c.cmd(true, "RSET")
+	if s, want := c.cmd(true, "STAT"), "2 "+strconv.Itoa(2*size); s != want {
+		t.Errorf("STAT after RSET = %q, want %q", s, want)
+	}
+
+	c.cmd(true, "DELE 2")
+	c.cmd(true, "QUIT")
+
+	left, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 1 || left[0].Key() != msgs[0].Key() {
+		t.Fatalf("Messages() after QUIT = %v messages, want the first one", len(left))
+	}
+	if left[0].Flags().Has(maildirpp.FlagTrashed) {
+		t.Errorf("message still flagged with FlagTrashed after RSET")
+	}
+}
+
+func TestServer_disconnect(t *testing.T) {
+	t.Parallel()
+	d := newTestDir(t, 1)
+	dial := newTestServer(t, string(d.Dir))
+
+	c := dial()
+	login(c)
+	c.cmd(false, "USER bob")
+
+	other := dial()
+	other.cmd(true, "USER bob")
+	if s := other.cmd(false, "PASS secret"); !strings.HasPrefix(s, "[IN-USE]") {
+		t.Errorf("PASS on locked maildrop = %q, want [IN-USE] code", s)
+	}
+
+	c.cmd(true, "DELE 1")
+	c.text.Close()
+
+	// the maildrop is unlocked once the session is closed
+	var c2 *testClient
+	for c2 == nil {
+		c2 = dial()
+		c2.cmd(true, "USER bob")
+		if err := c2.text.PrintfLine("PASS secret"); err != nil {
+			t.Fatal(err)
+		}
+		line, err := c2.text.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "+OK") {
+			c2 = nil
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if s := c2.cmd(true, "STAT"); !strings.HasPrefix(s, "1 ") {
+		t.Errorf("STAT after disconnect = %q, want 1 message", s)
+	}
+	c2.cmd(true, "QUIT")
+
+	msgs, err := d.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("Messages() = %v messages, want 1", len(msgs))
+	}
+	if msgs[0].Flags().Has(maildirpp.FlagTrashed) {
+		t.Errorf("deletion not reverted after disconnect")
+	}
+}
+
+func TestServer_sizeWithoutW(t *testing.T) {
+	t.Parallel()
+	d := maildirpp.NewDir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	// S= counts LF line endings, it must not be used as the size. The second
+	// message has a LF at the start of the second 32 KiB block read.
+	header := "Subject: Long\n\n"
+	long := header + strings.Repeat("a", 32*1024-len(header)) + "\nBye\n"
+	msgs := []string{testMessage, long}
+	for _, msg := range msgs {
+		err := maildirpp.Deliver(string(d.Dir), strings.NewReader(msg), nil, maildirpp.DovecotMessageSize())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestServer(t, string(d.Dir))()
+	login(c)
+
+	// Both messages may have the same arrival time, so ignore the order
+	var want, got []string
+	for _, msg := range msgs {
+		want = append(want, strconv.Itoa(len(strings.ReplaceAll(msg, "\n", "\r\n"))))
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(c.multiline("LIST"), "\n"), "\n") {
+		_, size, _ := strings.Cut(line, " ")
+		got = append(got, size)
+	}
+	slices.Sort(want)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("LIST sizes = %v, want %v", got, want)
+	}
+}
+
+func TestUniqueID(t *testing.T) {
+	for _, tc := range []struct {
+		key    string
+		hashed bool
+	}{
+		{key: "1700000000.M1P2Q3.host,S=42,W=44"},
+		{key: "1700000000.M1P2Q3.ho st", hashed: true},
+		{key: strings.Repeat("x", 71), hashed: true},
+	} {
+		uid := uniqueID(tc.key)
+		base, _, _ := strings.Cut(tc.key, ",")
+		if (uid != base) != tc.hashed {
+			t.Errorf("uniqueID(%q) = %q, hashed: %v", tc.key, uid, tc.hashed)
+		}
+		if len(uid) > maxUIDLength {
+			t.Errorf("uniqueID(%q) = %q, too long", tc.key, uid)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package pop3
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// maxUIDLength is the maximum length of a unique ID, per RFC 1939.
+const maxUIDLength = 70
+
+// message is a message of the maildrop. Message numbers are indices in
+// session.msgs plus one.
+type message struct {
+	*maildirpp.Message
+	size    int64
+	uid     string
+	deleted bool
+	trashed bool // whether FlagTrashed was set before the session
+}
+
+// session is a POP3 session. No maildrop is locked until the client
+// authenticates.
+type session struct {
+	server *Server
+	conn   net.Conn
+	text   *textproto.Conn
+
+	username string // given by USER
+	dir      string // locked maildrop
+	msgs     []*message
+	quit     bool
+}
+
+func newSession(server *Server, conn net.Conn) *session {
+	return &session{
+		server: server,
+		conn:   conn,
+		text:   textproto.NewConn(conn),
+	}
+}
+
+func (sess *session) serve() error {
+	if err := sess.writeOK("POP3 server ready"); err != nil {
+		return err
+	}
+	for !sess.quit {
+		sess.conn.SetDeadline(time.Now().Add(sess.server.timeout))
+		line, err := sess.text.ReadLine()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		if err := sess.handle(strings.ToUpper(cmd), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close releases the maildrop. Deletions are reverted unless the client quit.
+func (sess *session) close() {
+	if sess.dir == "" {
+		return
+	}
+	if !sess.quit {
+		sess.reset()
+	}
+	sess.server.unlock(sess.dir)
+	sess.dir = ""
+}
+
+func (sess *session) writeOK(format string, args ...interface{}) error {
+	return sess.text.PrintfLine("+OK "+format, args...)
+}
+
+func (sess *session) writeErr(format string, args ...interface{}) error {
+	return sess.text.PrintfLine("-ERR "+format, args...)
+}
+
+// handle executes a command. Errors are only returned on I/O failures,
+// command failures are reported to the client.
+func (sess *session) handle(cmd, arg string) error {
+	switch cmd {
+	case "CAPA":
+		return sess.handleCapa()
+	case "QUIT":
+		return sess.handleQuit()
+	}
+
+	if sess.dir == "" {
+		switch cmd {
+		case "USER":
+			return sess.handleUser(arg)
+		case "PASS":
+			return sess.handlePass(arg)
+		}
+		return sess.writeErr("Unknown command or not authenticated")
+	}
+
+	switch cmd {
+	case "STAT":
+		return sess.handleStat()
+	case "LIST":
+		return sess.handleList(arg)
+	case "UIDL":
+		return sess.handleUIDL(arg)
+	case "RETR":
+		return sess.handleRetr(arg)
+	case "TOP":
+		return sess.handleTop(arg)
+	case "DELE":
+		return sess.handleDele(arg)
+	case "NOOP":
+		return sess.writeOK("Nothing to do")
+	case "RSET":
+		if err := sess.reset(); err != nil {
+			return sess.writeErr("[SYS/TEMP] %v", err)
+		}
+		return sess.writeOK("Maildrop has %v messages", len(sess.msgs))
+	}
+	return sess.writeErr("Unknown command")
+}
+
+func (sess *session) handleCapa() error {
+	if err := sess.writeOK("Capability list follows"); err != nil {
+		return err
+	}
+	w := sess.text.DotWriter()
+	io.WriteString(w, "TOP\nUIDL\nUSER\nRESP-CODES\nAUTH-RESP-CODE\n")
+	return w.Close()
+}
+
+func (sess *session) handleUser(arg string) error {
+	if arg == "" {
+		return sess.writeErr("Missing username")
+	}
+	sess.username = arg
+	return sess.writeOK("Send PASS")
+}
+
+func (sess *session) handlePass(arg string) error {
+	username := sess.username
+	sess.username = ""
+	if username == "" {
+		return sess.writeErr("USER command required first")
+	}
+
+	dir, err := sess.server.authenticate(username, arg)
+	if err != nil {
+		return sess.writeErr("[AUTH] Invalid credentials")
+	}
+	dir = filepath.Clean(dir)
+	if !sess.server.lock(dir) {
+		return sess.writeErr("[IN-USE] Maildrop already locked")
+	}
+	msgs, err := load(maildirpp.NewDir(dir))
+	if err != nil {
+		sess.server.unlock(dir)
+		return sess.writeErr("[SYS/TEMP] Failed to open maildrop: %v", err)
+	}
+	sess.dir = dir
+	sess.msgs = msgs
+	return sess.writeOK("Maildrop has %v messages", len(msgs))
+}
+
+// load moves the new messages of a Maildir to cur, and returns the messages
+// in delivery order. Malformed files are skipped.
+func load(d *maildirpp.Dir) ([]*message, error) {
+	if _, err := d.Unseen(); err != nil {
+		return nil, err
+	}
+	msgs, err := d.Messages()
+	var (
+		mailfileErr *maildirpp.MailfileError
+		flagErr     *maildirpp.FlagError
+	)
+	if err != nil && !errors.As(err, &mailfileErr) && !errors.As(err, &flagErr) {
+		return nil, err
+	}
+	if err := maildirpp.SortMessages(msgs, maildirpp.SortCriterion{Key: maildirpp.SortArrival}); err != nil {
+		return nil, err
+	}
+
+	l := make([]*message, len(msgs))
+	for i, msg := range msgs {
+		size, err := messageSize(msg)
+		if err != nil {
+			return nil, &maildirpp.MessageError{Key: msg.Key(), Err: err}
+		}
+		l[i] = &message{
+			Message: msg,
+			size:    size,
+			uid:     uniqueID(msg.Key()),
+			trashed: msg.Flags().Has(maildirpp.FlagTrashed),
+		}
+	}
+	return l, nil
+}
+
+// messageSize returns the size of a message with CRLF line endings, as sent
+// by RETR. Without W= attribute, it is computed by reading the message.
+func messageSize(msg *maildirpp.Message) (int64, error) {
+	if v, ok := msg.Attributes().Get("W"); ok {
+		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return size, nil
+		}
+	}
+
+	r, err := msg.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	size := maildirpp.DovecotMessageRFC822Size()
+	if _, err := io.Copy(size, r); err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(size.Compute(), 10, 64)
+}
+
+// uniqueID returns the unique ID of a message, made of the key without its
+// attributes. Keys which are too long or contain characters not allowed by
+// RFC 1939 are hashed.
+func uniqueID(key string) string {
+	base, _, _ := strings.Cut(key, ",")
+	ok := len(base) > 0 && len(base) <= maxUIDLength
+	for i := 0; ok && i < len(base); i++ {
+		ok = base[i] >= 0x21 && base[i] <= 0x7E
+	}
+	if ok {
+		return base
+	}
+	sum := sha256.Sum256([]byte(base))
+	return hex.EncodeToString(sum[:])
+}
+
+// message returns the message with the number given as argument. Deleted
+// messages cannot be referenced.
+func (sess *session) message(arg string) (int, *message, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 || n > len(sess.msgs) {
+		return 0, nil, false
+	}
+	msg := sess.msgs[n-1]
+	if msg.deleted {
+		return 0, nil, false
+	}
+	return n, msg, true
+}
+
+func (sess *session) handleStat() error {
+	var (
+		count int
+		size  int64
+	)
+	for _, msg := range sess.msgs {
+		if !msg.deleted {
+			count++
+			size += msg.size
+		}
+	}
+	return sess.writeOK("%v %v", count, size)
+}
+
+func (sess *session) handleList(arg string) error {
+	return sess.writeListing(arg, func(msg *message) string {
+		return strconv.FormatInt(msg.size, 10)
+	})
+}
+
+func (sess *session) handleUIDL(arg string) error {
+	return sess.writeListing(arg, func(msg *message) string {
+		return msg.uid
+	})
+}
+
+// writeListing writes the response of LIST or UIDL, for a single message if
+// arg is not empty.
+func (sess *session) writeListing(arg string, value func(*message) string) error {
+	if arg != "" {
+		n, msg, ok := sess.message(arg)
+		if !ok {
+			return sess.writeErr("No such message")
+		}
+		return sess.writeOK("%v %v", n, value(msg))
+	}
+
+	if err := sess.writeOK("Listing follows"); err != nil {
+		return err
+	}
+	w := sess.text.DotWriter()
+	for i, msg := range sess.msgs {
+		if !msg.deleted {
+			fmt.Fprintf(w, "%v %v\n", i+1, value(msg))
+		}
+	}
+	return w.Close()
+}
+
+func (sess *session) handleRetr(arg string) error {
+	_, msg, ok := sess.message(arg)
+	if !ok {
+		return sess.writeErr("No such message")
+	}
+	return sess.writeContent(msg, fmt.Sprintf("%v octets", msg.size), func(w io.Writer, r io.Reader) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+func (sess *session) handleTop(arg string) error {
+	numArg, linesArg, _ := strings.Cut(arg, " ")
+	_, msg, ok := sess.message(numArg)
+	if !ok {
+		return sess.writeErr("No such message")
+	}
+	lines, err := strconv.Atoi(linesArg)
+	if err != nil || lines < 0 {
+		return sess.writeErr("Invalid number of lines")
+	}
+	return sess.writeContent(msg, "Top of message follows", func(w io.Writer, r io.Reader) error {
+		return writeTop(w, r, lines)
+	})
+}
+
+// writeContent streams the content of a message with copy. The DotWriter
+// dot-stuffs the lines and converts LF line endings to CRLF.
+func (sess *session) writeContent(msg *message, status string, copy func(io.Writer, io.Reader) error) error {
+	r, err := msg.Open()
+	if err != nil {
+		return sess.writeErr("[SYS/TEMP] Failed to open message: %v", err)
+	}
+	defer r.Close()
+
+	if err := sess.writeOK("%v", status); err != nil {
+		return err
+	}
+	w := sess.text.DotWriter()
+	err = copy(w, r)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeTop writes the header of a message, the blank line separating it
+// from the body, and the first lines of the body.
+func writeTop(w io.Writer, r io.Reader, lines int) error {
+	br := bufio.NewReader(r)
+	inBody := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if inBody {
+				if lines == 0 {
+					return nil
+				}
+				lines--
+			} else if s := string(line); s == "\n" || s == "\r\n" {
+				inBody = true
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (sess *session) handleDele(arg string) error {
+	n, msg, ok := sess.message(arg)
+	if !ok {
+		return sess.writeErr("No such message")
+	}
+	if !msg.trashed {
+		if err := msg.AddFlags(maildirpp.FlagTrashed); err != nil {
+			return sess.writeErr("[SYS/TEMP] Failed to delete message: %v", err)
+		}
+	}
+	msg.deleted = true
+	return sess.writeOK("Message %v deleted", n)
+}
+
+// reset unmarks the deleted messages, removing FlagTrashed where DELE set
+// it.
+func (sess *session) reset() error {
+	var errs []error
+	for _, msg := range sess.msgs {
+		if !msg.deleted {
+			continue
+		}
+		if !msg.trashed {
+			if err := msg.RemoveFlags(maildirpp.FlagTrashed); err != nil {
+				errs = append(errs, &maildirpp.MessageError{Key: msg.Key(), Err: err})
+				continue
+			}
+		}
+		msg.deleted = false
+	}
+	return errors.Join(errs...)
+}
+
+// handleQuit ends the session, and removes the deleted messages if the
+// client is authenticated.
+func (sess *session) handleQuit() error {
+	sess.quit = true
+	if sess.dir == "" {
+		return sess.writeOK("Bye")
+	}
+
+	var errs []error
+	for _, msg := range sess.msgs {
+		if msg.deleted {
+			if err := msg.Remove(); err != nil {
+				errs = append(errs, &maildirpp.MessageError{Key: msg.Key(), Err: err})
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return sess.writeErr("[SYS/TEMP] Some deleted messages not removed: %v", err)
+	}
+	return sess.writeOK("Bye")
+}
@@ -0,0 +1,357 @@
+// Package queue uses a Maildir as a durable job queue, shared by several
+// producers and consumers.
+//
+// Producers add jobs by delivering messages to the Maildir, with Enqueue or
+// any Delivery. Consumers claim jobs with Claim: the message file is renamed
+// to cur with an owner and a lease expiry attribute, so that only one
+// consumer gets each job. A job is acknowledged by removing it, or released
+// with Nack, which stores the retry count and the time before which the job
+// is not claimed again in attributes. Jobs whose lease expired, e.g. because
+// their consumer crashed, are released by Recover.
+//
+// The state of a job only lives in the name of its file, which is changed
+// with atomic renames. A consumer which lost its lease notices it with
+// ErrLeaseLost.
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+// The attributes storing the state of a job. Times are Unix timestamps.
+const (
+	attrOwner   = "owner"
+	attrLease   = "lease"
+	attrRetries = "retries"
+	attrAfter   = "after"
+)
+
+// ErrEmpty is returned by Claim when no job is ready.
+var ErrEmpty = errors.New("queue: no job ready")
+
+// ErrLeaseLost is returned when a job was released by Recover, because its
+// lease expired, and possibly claimed by another consumer.
+var ErrLeaseLost = errors.New("queue: lease lost")
+
+// Queue is a job queue stored in a Maildir.
+type Queue struct {
+	dir *maildirpp.Dir
+	now func() time.Time
+}
+
+// New creates a queue on the Maildir d, which must be initialized.
+func New(d *maildirpp.Dir) *Queue {
+	return &Queue{dir: d, now: time.Now}
+}
+
+// Enqueue adds a job, with the content read from r.
+func (q *Queue) Enqueue(r io.Reader) error {
+	return maildirpp.Deliver(string(q.dir.Dir), r, nil, maildirpp.DovecotMessageSize())
+}
+
+// Claim claims the oldest ready job for owner, until the lease expires.
+// Owners are names made of letters, digits, '-', '_' and '.'. If no job is
+// ready, ErrEmpty is returned.
+func (q *Queue) Claim(owner string, lease time.Duration) (*Job, error) {
+	if !validOwner(owner) {
+		return nil, fmt.Errorf("queue: invalid owner %q", owner)
+	}
+
+	entries, err := q.entries()
+	if err != nil {
+		return nil, err
+	}
+	now := q.now()
+	for _, e := range entries {
+		if !e.ready(now) {
+			continue
+		}
+		attrs := e.copyAttrs()
+		attrs.Set(attrOwner, owner)
+		attrs.Set(attrLease, formatTime(now.Add(lease)))
+		claimed, err := q.rename(e, attrs)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // claimed by another consumer
+		} else if err != nil {
+			return nil, err
+		}
+		return q.newJob(claimed)
+	}
+	return nil, ErrEmpty
+}
+
+// Recover releases the jobs whose lease expired, and returns how many there
+// were. Their retry count is incremented.
+func (q *Queue) Recover() (int, error) {
+	entries, err := q.entries()
+	if err != nil {
+		return 0, err
+	}
+	now := q.now()
+	n := 0
+	var errs []error
+	for _, e := range entries {
+		if _, ok := e.attrs.Get(attrOwner); !ok {
+			continue
+		}
+		if deadline, ok := e.time(attrLease); ok && deadline.After(now) {
+			continue
+		}
+		attrs := e.copyAttrs()
+		delete(attrs, attrOwner)
+		delete(attrs, attrLease)
+		attrs.Set(attrRetries, strconv.Itoa(e.retries()+1))
+		if _, err := q.rename(e, attrs); errors.Is(err, fs.ErrNotExist) {
+			continue // recovered by another consumer, or extended
+		} else if err != nil {
+			errs = append(errs, &maildirpp.MessageError{Key: e.key, Err: err})
+			continue
+		}
+		n++
+	}
+	return n, errors.Join(errs...)
+}
+
+// entries returns the jobs of the queue in delivery order, i.e. by
+// modification time of their files. Malformed files are skipped.
+func (q *Queue) entries() ([]*entry, error) {
+	var entries []*entry
+	for _, sub := range []string{"new", "cur"} {
+		dir := filepath.Join(string(q.dir.Dir), sub)
+		dirEntries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, dirEntry := range dirEntries {
+			e, ok := parseEntry(dir, dirEntry.Name())
+			if !ok {
+				continue
+			}
+			fi, err := dirEntry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue // claimed or removed meanwhile
+			} else if err != nil {
+				return nil, err
+			}
+			e.mtime = fi.ModTime()
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *entry) int {
+		if c := a.mtime.Compare(b.mtime); c != 0 {
+			return c
+		}
+		return strings.Compare(a.key, b.key)
+	})
+	return entries, nil
+}
+
+// rename moves the file of a job to cur with new attributes, and returns the
+// new entry.
+func (q *Queue) rename(e *entry, attrs maildirpp.Attributes) (*entry, error) {
+	renamed := &entry{
+		filename: filepath.Join(string(q.dir.Dir), "cur", maildirpp.JoinBasename(e.key, attrs, e.info)),
+		key:      e.key,
+		attrs:    attrs,
+		info:     e.info,
+		mtime:    e.mtime,
+	}
+	if err := os.Rename(e.filename, renamed.filename); err != nil {
+		return nil, err
+	}
+	return renamed, nil
+}
+
+func (q *Queue) newJob(e *entry) (*Job, error) {
+	msg, err := q.dir.MessageByKey(e.fullKey())
+	if err != nil {
+		return nil, err
+	}
+	return &Job{queue: q, entry: e, msg: msg}, nil
+}
+
+// Job is a job claimed by a consumer.
+type Job struct {
+	queue *Queue
+	entry *entry
+	msg   *maildirpp.Message
+}
+
+// Key returns the key of the job, which is stable across claims.
+func (j *Job) Key() string {
+	return j.entry.key
+}
+
+// Owner returns the owner of the job.
+func (j *Job) Owner() string {
+	owner, _ := j.entry.attrs.Get(attrOwner)
+	return owner
+}
+
+// Deadline returns the time at which the lease expires.
+func (j *Job) Deadline() time.Time {
+	t, _ := j.entry.time(attrLease)
+	return t
+}
+
+// Retries returns the number of times the job was released without being
+// acknowledged.
+func (j *Job) Retries() int {
+	return j.entry.retries()
+}
+
+// Message returns the message holding the job.
+func (j *Job) Message() *maildirpp.Message {
+	return j.msg
+}
+
+// Open opens the content of the job for reading.
+func (j *Job) Open() (maildirpp.MessageReader, error) {
+	return j.msg.Open()
+}
+
+// Ack removes the job from the queue.
+func (j *Job) Ack() error {
+	return leaseError(os.Remove(j.entry.filename))
+}
+
+// Nack releases the job, so that it can be claimed again after backoff. Its
+// retry count is incremented.
+func (j *Job) Nack(backoff time.Duration) error {
+	attrs := j.entry.copyAttrs()
+	delete(attrs, attrOwner)
+	delete(attrs, attrLease)
+	attrs.Set(attrRetries, strconv.Itoa(j.entry.retries()+1))
+	if backoff > 0 {
+		attrs.Set(attrAfter, formatTime(j.queue.now().Add(backoff)))
+	} else {
+		delete(attrs, attrAfter)
+	}
+	_, err := j.queue.rename(j.entry, attrs)
+	return leaseError(err)
+}
+
+// Extend renews the lease of the job, which then expires after lease.
+func (j *Job) Extend(lease time.Duration) error {
+	attrs := j.entry.copyAttrs()
+	attrs.Set(attrLease, formatTime(j.queue.now().Add(lease)))
+	e, err := j.queue.rename(j.entry, attrs)
+	if err != nil {
+		return leaseError(err)
+	}
+	msg, err := j.queue.dir.MessageByKey(e.fullKey())
+	if err != nil {
+		return err
+	}
+	j.entry = e
+	j.msg = msg
+	return nil
+}
+
+// leaseError reports a missing job file as a lost lease.
+func leaseError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// entry is a job file. Files in new might have no info.
+type entry struct {
+	filename string
+	key      string // without attributes
+	attrs    maildirpp.Attributes
+	info     string
+	mtime    time.Time // set by Queue.entries
+}
+
+// parseEntry parses the name of a job file. Hidden and malformed files are
+// skipped.
+func parseEntry(dir, name string) (*entry, bool) {
+	if strings.HasPrefix(name, ".") {
+		return nil, false
+	}
+	key, attrs, info, err := maildirpp.SplitBasename(name)
+	if err != nil {
+		return nil, false
+	}
+	return &entry{
+		filename: filepath.Join(dir, name),
+		key:      key,
+		attrs:    attrs,
+		info:     info,
+	}, true
+}
+
+// fullKey returns the key of the message holding the job.
+func (e *entry) fullKey() string {
+	if ext := e.attrs.String(); ext != "" {
+		return e.key + "," + ext
+	}
+	return e.key
+}
+
+func (e *entry) copyAttrs() maildirpp.Attributes {
+	attrs := make(maildirpp.Attributes, len(e.attrs)+2)
+	for k, v := range e.attrs {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// ready reports whether the job can be claimed.
+func (e *entry) ready(now time.Time) bool {
+	if _, ok := e.attrs.Get(attrOwner); ok {
+		return false
+	}
+	after, ok := e.time(attrAfter)
+	return !ok || !after.After(now)
+}
+
+func (e *entry) time(attr string) (time.Time, bool) {
+	v, ok := e.attrs.Get(attr)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+func (e *entry) retries() int {
+	v, _ := e.attrs.Get(attrRetries)
+	n, _ := strconv.Atoi(v)
+	return n
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func validOwner(owner string) bool {
+	if owner == "" {
+		return false
+	}
+	for _, c := range owner {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
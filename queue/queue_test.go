@@ -0,0 +1,231 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-maildir/maildirpp"
+)
+
+func newTestQueue(t *testing.T) (*Queue, *time.Time) {
+	d := maildirpp.NewDir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	q := New(d)
+	q.now = func() time.Time { return now }
+	return q, &now
+}
+
+func enqueue(t *testing.T, q *Queue, bodies ...string) {
+	for _, body := range bodies {
+		if err := q.Enqueue(strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		// jobs are ordered by modification time
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readJob(t *testing.T, job *Job) string {
+	r, err := job.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestQueue(t *testing.T) {
+	q, now := newTestQueue(t)
+	enqueue(t, q, "first", "second")
+
+	first, err := q.Claim("worker-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readJob(t, first); s != "first" {
+		t.Errorf("first claimed job = %q, want %q", s, "first")
+	}
+	if owner := first.Owner(); owner != "worker-1" {
+		t.Errorf("Owner() = %q, want worker-1", owner)
+	}
+	if deadline := first.Deadline(); deadline.Unix() != now.Add(time.Minute).Unix() {
+		t.Errorf("Deadline() = %v, want %v", deadline, now.Add(time.Minute))
+	}
+
+	second, err := q.Claim("worker-2", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readJob(t, second); s != "second" {
+		t.Errorf("second claimed job = %q, want %q", s, "second")
+	}
+	if _, err := q.Claim("worker-1", time.Minute); err != ErrEmpty {
+		t.Fatalf("Claim() on empty queue = %v, want ErrEmpty", err)
+	}
+
+	if err := first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Nack(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim("worker-1", time.Minute); err != ErrEmpty {
+		t.Fatalf("Claim() during backoff = %v, want ErrEmpty", err)
+	}
+
+	*now = now.Add(2 * time.Minute)
+	retried, err := q.Claim("worker-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Key() != second.Key() {
+		t.Errorf("Key() = %q after Nack, want %q", retried.Key(), second.Key())
+	}
+	if n := retried.Retries(); n != 1 {
+		t.Errorf("Retries() = %v, want 1", n)
+	}
+	if s := readJob(t, retried); s != "second" {
+		t.Errorf("retried job = %q, want %q", s, "second")
+	}
+	if err := retried.Ack(); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs, err := q.dir.Messages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("Messages() = %v messages after Ack, want none", len(msgs))
+	}
+}
+
+func TestQueue_recover(t *testing.T) {
+	q, now := newTestQueue(t)
+	enqueue(t, q, "job")
+
+	job, err := q.Claim("worker-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(30 * time.Second)
+	if err := job.Extend(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(45 * time.Second)
+	if n, err := q.Recover(); err != nil || n != 0 {
+		t.Fatalf("Recover() with extended lease = %v, %v, want 0", n, err)
+	}
+
+	*now = now.Add(time.Minute)
+	if n, err := q.Recover(); err != nil || n != 1 {
+		t.Fatalf("Recover() = %v, %v, want 1", n, err)
+	}
+	if err := job.Ack(); err != ErrLeaseLost {
+		t.Errorf("Ack() after recovery = %v, want ErrLeaseLost", err)
+	}
+
+	job, err = q.Claim("worker-2", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := job.Retries(); n != 1 {
+		t.Errorf("Retries() = %v after recovery, want 1", n)
+	}
+	if s := readJob(t, job); s != "job" {
+		t.Errorf("recovered job = %q, want %q", s, "job")
+	}
+}
+
+func TestQueue_concurrent(t *testing.T) {
+	q, _ := newTestQueue(t)
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := q.Enqueue(strings.NewReader(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		claimed = make(map[string]int)
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := q.Claim(fmt.Sprintf("worker-%v", w), time.Minute)
+				if errors.Is(err, ErrEmpty) {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				mutex.Lock()
+				claimed[job.Key()]++
+				mutex.Unlock()
+				if err := job.Ack(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != n {
+		t.Errorf("claimed %v jobs, want %v", len(claimed), n)
+	}
+	for key, count := range claimed {
+		if count != 1 {
+			t.Errorf("job %v claimed %v times", key, count)
+		}
+	}
+}
+
+func TestQueue_infoInNew(t *testing.T) {
+	q, _ := newTestQueue(t)
+	// some delivery agents write files with an info section to new
+	name := "1700000000.M1P2Q3.host,S=3" + string(maildirpp.InfoSeparator) + "2,"
+	if err := os.WriteFile(filepath.Join(string(q.dir.Dir), "new", name), []byte("job"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := q.Claim("worker-1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := job.Key(); key != "1700000000.M1P2Q3.host" {
+		t.Errorf("Key() = %q, want the base key", key)
+	}
+	if s := readJob(t, job); s != "job" {
+		t.Errorf("job = %q, want %q", s, "job")
+	}
+	if err := job.Ack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueue_invalidOwner(t *testing.T) {
+	q, _ := newTestQueue(t)
+	for _, owner := range []string{"", "a,b", "a=b", "a:b", "a/b"} {
+		if _, err := q.Claim(owner, time.Minute); err == nil || err == ErrEmpty {
+			t.Errorf("Claim(%q) = %v, want invalid owner error", owner, err)
+		}
+	}
+}
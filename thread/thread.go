@@ -0,0 +1,398 @@
+// Package thread builds conversation threads from the messages of one or
+// several Maildir directories, with the algorithms of RFC 5256 THREAD.
+package thread
+
+import (
+	"cmp"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-maildir"
+)
+
+// Algorithm is a threading algorithm.
+type Algorithm int
+
+const (
+	// References links messages with their Message-Id, In-Reply-To and
+	// References header fields, and then groups the threads with the same
+	// base subject. It is the algorithm of Jamie Zawinski, as specified by
+	// RFC 5256.
+	References Algorithm = iota
+	// OrderedSubject groups messages by base subject. In each thread, the
+	// first message is the parent of all the others.
+	OrderedSubject
+)
+
+// Node is a node of a thread tree.
+type Node struct {
+	// The directory and the key of the message. They are empty for a dummy
+	// node, which groups messages whose common parent is missing.
+	Dir, Key string
+	// The replies, sorted by date.
+	Children []*Node
+}
+
+// Walker walks the messages of a directory. It is implemented by the Dir and
+// Cache types of the maildir and maildirpp packages.
+type Walker interface {
+	Walk(fn func(*maildir.Message) error) error
+}
+
+// Threader builds threads from messages. Messages can be added at any time,
+// e.g. when new messages are returned by Dir.Unseen, and the threads are
+// computed again on demand.
+type Threader struct {
+	algorithm Algorithm
+	messages  map[string]*message // by directory and key
+	list      []*message          // in the order they were added
+	ids       map[string]*container
+	// All the containers, in the order they were created. Containers of
+	// messages without Message-Id are not in ids.
+	containers []*container
+}
+
+type message struct {
+	dir, key string
+	seq      int
+	date     time.Time
+	subject  string
+}
+
+// container is a node of the Message-Id graph of the References algorithm.
+type container struct {
+	msg      *message // nil for a message which was only referenced
+	parent   *container
+	children []*container
+}
+
+// New creates a Threader using the given algorithm.
+func New(algorithm Algorithm) *Threader {
+	return &Threader{
+		algorithm: algorithm,
+		messages:  make(map[string]*message),
+		ids:       make(map[string]*container),
+	}
+}
+
+// Add adds messages. Messages which were already added are ignored.
+//
+// The headers of the messages are read, from the cache if the messages were
+// obtained from one. Messages whose header cannot be read are skipped, and
+// their errors are returned as *maildir.MessageError.
+func (t *Threader) Add(msgs ...*maildir.Message) error {
+	var errs []error
+	for _, msg := range msgs {
+		if err := t.add(msg); err != nil {
+			errs = append(errs, &maildir.MessageError{Key: msg.Key(), Err: err})
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// AddAll adds all the messages of a directory, like Add.
+func (t *Threader) AddAll(w Walker) error {
+	var errs []error
+	walkErr := w.Walk(func(msg *maildir.Message) error {
+		if err := t.add(msg); err != nil {
+			errs = append(errs, &maildir.MessageError{Key: msg.Key(), Err: err})
+		}
+		return nil
+	})
+	return errors.Join(append([]error{walkErr}, errs...)...)
+}
+
+func (t *Threader) add(msg *maildir.Message) error {
+	dir := filepath.Dir(filepath.Dir(msg.Filename()))
+	id := dir + "\x00" + msg.Key()
+	if _, ok := t.messages[id]; ok {
+		return nil
+	}
+
+	h, err := msg.Header()
+	if err != nil {
+		return err
+	}
+	date, err := h.Date()
+	if err != nil || date.IsZero() {
+		if date, err = msg.InternalDate(); err != nil {
+			return err
+		}
+	}
+	subject, err := h.Subject()
+	if err != nil {
+		subject = h.Get("Subject")
+	}
+
+	m := &message{
+		dir:     dir,
+		key:     msg.Key(),
+		seq:     len(t.list),
+		date:    date,
+		subject: subject,
+	}
+	t.messages[id] = m
+	t.list = append(t.list, m)
+	t.link(m, h)
+	return nil
+}
+
+// link adds a message to the Message-Id graph.
+func (t *Threader) link(m *message, h *maildir.Header) {
+	refs := parseMsgIDs(h.Get("References"))
+	if len(refs) == 0 {
+		if ids := parseMsgIDs(h.Get("In-Reply-To")); len(ids) > 0 {
+			refs = ids[:1]
+		}
+	}
+
+	// link the references together, without changing the existing links
+	var prev *container
+	for _, id := range refs {
+		c := t.container(id)
+		if prev != nil && c.parent == nil && !c.isAncestorOf(prev) {
+			c.setParent(prev)
+		}
+		prev = c
+	}
+
+	// messages without Message-Id, and duplicates, get a unique container
+	var c *container
+	if ids := parseMsgIDs(h.Get("Message-Id")); len(ids) > 0 {
+		c = t.container(ids[0])
+		if c.msg != nil {
+			c = nil
+		}
+	}
+	if c == nil {
+		c = &container{}
+		t.containers = append(t.containers, c)
+	}
+	c.msg = m
+
+	// the references of the message are more authoritative than the ones of
+	// the other messages
+	if prev != nil && !c.isAncestorOf(prev) {
+		c.setParent(prev)
+	}
+}
+
+// container returns the container of a Message-Id, and creates it if needed.
+func (t *Threader) container(id string) *container {
+	c, ok := t.ids[id]
+	if !ok {
+		c = &container{}
+		t.ids[id] = c
+		t.containers = append(t.containers, c)
+	}
+	return c
+}
+
+// isAncestorOf reports whether c is other or one of its ancestors.
+func (c *container) isAncestorOf(other *container) bool {
+	for ; other != nil; other = other.parent {
+		if other == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		c.parent.children = slices.DeleteFunc(c.parent.children, func(child *container) bool {
+			return child == c
+		})
+	}
+	c.parent = parent
+	parent.children = append(parent.children, c)
+}
+
+// parseMsgIDs returns the message identifiers between angle brackets in a
+// header field value.
+func parseMsgIDs(v string) []string {
+	var ids []string
+	for {
+		i := strings.IndexByte(v, '<')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(v[i:], '>')
+		if j < 0 {
+			break
+		}
+		if id := strings.TrimSpace(v[i+1 : i+j]); id != "" {
+			ids = append(ids, id)
+		}
+		v = v[i+j+1:]
+	}
+	return ids
+}
+
+// Threads returns the threads of the messages added so far, sorted by the
+// date of their first message. Dates are read from the Date header field, or
+// are the internal dates of the messages when the field is missing or
+// invalid.
+func (t *Threader) Threads() []*Node {
+	var roots []*node
+	switch t.algorithm {
+	case OrderedSubject:
+		roots = t.orderedSubject()
+	default:
+		roots = t.references()
+	}
+	sortNodes(roots)
+	return exportNodes(roots)
+}
+
+// node is a node of a thread tree being built.
+type node struct {
+	msg      *message // nil for a dummy node
+	children []*node
+}
+
+// first returns the message used to sort a node: its own message, or the
+// first one of its children for a dummy node.
+func (n *node) first() *message {
+	for n.msg == nil {
+		n = n.children[0]
+	}
+	return n.msg
+}
+
+func (n *node) baseSubject() (string, bool) {
+	return maildir.BaseSubject(n.first().subject)
+}
+
+func (c *container) tree() *node {
+	n := &node{msg: c.msg}
+	for _, child := range c.children {
+		n.children = append(n.children, child.tree())
+	}
+	return n
+}
+
+func (t *Threader) references() []*node {
+	var roots []*node
+	for _, c := range t.containers {
+		if c.parent == nil {
+			roots = append(roots, c.tree())
+		}
+	}
+	roots = prune(roots, true)
+	return groupBySubject(roots)
+}
+
+// prune removes the dummy nodes without children, and replaces the other
+// dummy nodes with their children. At the root level, dummy nodes are only
+// replaced when they have a single child.
+func prune(nodes []*node, root bool) []*node {
+	var pruned []*node
+	for _, n := range nodes {
+		n.children = prune(n.children, false)
+		switch {
+		case n.msg == nil && len(n.children) == 0:
+			// drop it
+		case n.msg == nil && (!root || len(n.children) == 1):
+			pruned = append(pruned, n.children...)
+		default:
+			pruned = append(pruned, n)
+		}
+	}
+	return pruned
+}
+
+// groupBySubject merges the threads with the same base subject.
+func groupBySubject(roots []*node) []*node {
+	table := make(map[string]*node)
+	for _, n := range roots {
+		base, isReply := n.baseSubject()
+		if base == "" {
+			continue
+		}
+		old, ok := table[base]
+		if !ok || old.msg != nil && n.msg == nil {
+			table[base] = n
+		} else if old.msg != nil && n.msg != nil {
+			if _, oldIsReply := old.baseSubject(); oldIsReply && !isReply {
+				table[base] = n
+			}
+		}
+	}
+
+	var grouped []*node
+	for _, n := range roots {
+		base, isReply := n.baseSubject()
+		old := table[base]
+		if base == "" || old == n {
+			grouped = append(grouped, n)
+			continue
+		}
+		_, oldIsReply := old.baseSubject()
+		switch {
+		case old.msg == nil && n.msg == nil:
+			old.children = append(old.children, n.children...)
+		case old.msg == nil, isReply && !oldIsReply:
+			old.children = append(old.children, n)
+		default:
+			// turn old into a dummy node, with the same position in the
+			// table and in the roots
+			sibling := *old
+			*old = node{children: []*node{&sibling, n}}
+		}
+	}
+	return grouped
+}
+
+func (t *Threader) orderedSubject() []*node {
+	msgs := slices.Clone(t.list)
+	slices.SortStableFunc(msgs, compareMessages)
+
+	groups := make(map[string]*node)
+	var roots []*node
+	for _, m := range msgs {
+		base, _ := maildir.BaseSubject(m.subject)
+		if parent, ok := groups[base]; ok {
+			parent.children = append(parent.children, &node{msg: m})
+			continue
+		}
+		n := &node{msg: m}
+		groups[base] = n
+		roots = append(roots, n)
+	}
+	return roots
+}
+
+// sortNodes sorts nodes and their descendants by date. Messages with the
+// same date are sorted in the order they were added.
+func sortNodes(nodes []*node) {
+	for _, n := range nodes {
+		sortNodes(n.children)
+	}
+	slices.SortStableFunc(nodes, func(a, b *node) int {
+		return compareMessages(a.first(), b.first())
+	})
+}
+
+func compareMessages(a, b *message) int {
+	if c := a.date.Compare(b.date); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.seq, b.seq)
+}
+
+func exportNodes(nodes []*node) []*Node {
+	var l []*Node
+	for _, n := range nodes {
+		out := &Node{Children: exportNodes(n.children)}
+		if n.msg != nil {
+			out.Dir = n.msg.dir
+			out.Key = n.msg.key
+		}
+		l = append(l, out)
+	}
+	return l
+}
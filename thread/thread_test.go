@@ -0,0 +1,168 @@
+package thread
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-maildir"
+)
+
+// formatThreads formats threads like an IMAP THREAD response, with the
+// subjects of the messages instead of their sequence numbers.
+func formatThreads(nodes []*Node, subjects map[string]string) string {
+	var sb strings.Builder
+	var format func(n *Node)
+	format = func(n *Node) {
+		if n.Key == "" {
+			sb.WriteString("dummy")
+		} else {
+			sb.WriteString(subjects[n.Key])
+		}
+		switch len(n.Children) {
+		case 0:
+		case 1:
+			sb.WriteString(" ")
+			format(n.Children[0])
+		default:
+			sb.WriteString(" ")
+			for _, child := range n.Children {
+				sb.WriteString("(")
+				format(child)
+				sb.WriteString(")")
+			}
+		}
+	}
+	for _, n := range nodes {
+		sb.WriteString("(")
+		format(n)
+		sb.WriteString(")")
+	}
+	return sb.String()
+}
+
+type testMessage struct {
+	name, id, inReplyTo, references, subject string
+	day                                      int
+}
+
+func appendTestMessage(t *testing.T, d *maildir.Dir, m testMessage, names map[string]string) *maildir.Message {
+	t.Helper()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Date: %d Nov 2009 10:00:00 +0000\r\n", m.day)
+	if m.id != "" {
+		fmt.Fprintf(&sb, "Message-Id: <%s>\r\n", m.id)
+	}
+	if m.inReplyTo != "" {
+		fmt.Fprintf(&sb, "In-Reply-To: <%s>\r\n", m.inReplyTo)
+	}
+	if m.references != "" {
+		fmt.Fprintf(&sb, "References: %s\r\n", m.references)
+	}
+	fmt.Fprintf(&sb, "Subject: %s\r\n\r\nbody\r\n", m.subject)
+
+	msg, err := d.Append(strings.NewReader(sb.String()), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names[msg.Key()] = m.name
+	return msg
+}
+
+func newTestDir(t *testing.T) *maildir.Dir {
+	t.Helper()
+	d := maildir.NewDir(t.TempDir())
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestThreader_references(t *testing.T) {
+	t.Parallel()
+	inbox := newTestDir(t)
+	sent := newTestDir(t)
+	names := make(map[string]string)
+
+	for _, m := range []testMessage{
+		{name: "a", id: "a@x", subject: "Lunch", day: 1},
+		{name: "c", id: "c@x", references: "<a@x> <b@x>", subject: "Re: Lunch", day: 4},
+		{name: "d", id: "d@x", inReplyTo: "a@x", subject: "Re: Lunch", day: 3},
+		// replies to a missing message
+		{name: "f", id: "f@x", references: "<e@x>", subject: "Re: Report", day: 5},
+		{name: "g", id: "g@x", references: "<e@x>", subject: "Re: Report", day: 6},
+		// no references, grouped by subject
+		{name: "h", subject: "Re: Lunch", day: 7},
+		{name: "i", id: "i@x", subject: "Party", day: 2},
+		{name: "j", id: "j@x", subject: "Party", day: 8},
+	} {
+		appendTestMessage(t, inbox, m, names)
+	}
+	appendTestMessage(t, sent, testMessage{name: "b", id: "b@x", references: "<a@x>", subject: "Re: Lunch", day: 2}, names)
+
+	thr := New(References)
+	if err := thr.AddAll(inbox); err != nil {
+		t.Fatal(err)
+	}
+	if err := thr.AddAll(sent); err != nil {
+		t.Fatal(err)
+	}
+	// messages already added are ignored
+	if err := thr.AddAll(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "(a (b c)(d)(h))(dummy (i)(j))(dummy (f)(g))"
+	if got := formatThreads(thr.Threads(), names); got != want {
+		t.Errorf("Threads() = %v, want %v", got, want)
+	}
+
+	for _, n := range thr.Threads() {
+		if names[n.Key] == "a" && n.Children[0].Dir != string(sent.Dir) {
+			t.Errorf("Dir = %v, want %v", n.Children[0].Dir, sent.Dir)
+		}
+	}
+
+	// incremental update, e.g. from Unseen
+	msg := appendTestMessage(t, inbox, testMessage{name: "e", id: "e@x", subject: "Report", day: 4}, names)
+	if err := thr.Add(msg); err != nil {
+		t.Fatal(err)
+	}
+	want = "(a (b c)(d)(h))(dummy (i)(j))(e (f)(g))"
+	if got := formatThreads(thr.Threads(), names); got != want {
+		t.Errorf("Threads() after Add = %v, want %v", got, want)
+	}
+}
+
+func TestThreader_orderedSubject(t *testing.T) {
+	t.Parallel()
+	d := newTestDir(t)
+	names := make(map[string]string)
+
+	for _, m := range []testMessage{
+		{name: "a", subject: "Lunch", day: 3},
+		{name: "b", subject: "Re: lunch", day: 2},
+		{name: "c", subject: "Party", day: 4},
+		{name: "d", subject: "Fwd: Lunch", day: 5},
+		{name: "e", subject: "Party", day: 1},
+	} {
+		appendTestMessage(t, d, m, names)
+	}
+
+	thr := New(OrderedSubject)
+	if err := thr.AddAll(d); err != nil {
+		t.Fatal(err)
+	}
+	want := "(e c)(b (a)(d))"
+	if got := formatThreads(thr.Threads(), names); got != want {
+		t.Errorf("Threads() = %v, want %v", got, want)
+	}
+}
+
+func TestParseMsgIDs(t *testing.T) {
+	t.Parallel()
+	got := parseMsgIDs("<a@x> garbage <b@x>\r\n <> <c@x")
+	if len(got) != 2 || got[0] != "a@x" || got[1] != "b@x" {
+		t.Errorf("parseMsgIDs() = %v", got)
+	}
+}